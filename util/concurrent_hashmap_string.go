@@ -1,62 +1,932 @@
 package util
 
 import (
+	"container/heap"
+	"container/list"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const DEFAULT_SHARD_COUNT = 32
 
+// Errors returned by the ConcurrentMapString methods, match them with errors.Is.
+var (
+	ErrValueTooLarge = errors.New("value exceeds MaxValueBytes")
+	ErrTypeMismatch  = errors.New("value type mismatch")
+	ErrLoaderFailed  = errors.New("loader failed")
+	ErrMapFull       = errors.New("map holds MaxEntries entries")
+)
+
+// The core methods shared by the thread safe string maps, depend on it to swap
+// implementations or to inject test doubles.
+type ConcurrentMap interface {
+	Set(key string, value interface{})
+	Get(key string) (interface{}, bool)
+	Has(key string) bool
+	Remove(key string)
+	Count() int
+	Keys() []string
+	IterCb(fn IterCb)
+}
+
+var (
+	_ ConcurrentMap = (*ConcurrentMapString)(nil)
+	_ ConcurrentMap = (*MyMap)(nil)
+)
+
 // A "thread" safe map of type string:Anything.
 // To avoid lock bottlenecks this map is dived to several (DEFAULT_SHARD_COUNT) map shards.
+// The zero value is ready to use with the default options, so it can be embedded.
+// A nil *ConcurrentMapString is not: its methods panic naming the constructor.
 type ConcurrentMapString struct {
-	tables      []*concurrentMapSharedString
-	shard_count int
+	estCount int64  // total cached by EstimateCount. Keep the int64 fields first for 64-bit alignment.
+	estAt    int64  // UnixNano when estCount was refreshed
+	id       uint64 // orders the locks of different maps, see lockOrder
+	ops      opCounters
+	tables   []*concurrentMapSharedString
+	base     int          // number of shards addressed by the hash, tables[base:] are the sub-shards of split hot shards
+	rawKeys  bool         // keys are stored as given and hashed with fnv32, which GetBytes relies on
+	lock     sync.RWMutex // guards tables and base, which are swapped as a whole by ReplaceAll, Resize and hot shard splits
+	resizing int32        // 1 while an automatic resize is running
+	pinCount int32        // number of keys in pins
+	pins     sync.Map     // key => shard index overriding the placement, see PinKey
+	ring     atomic.Value // *hashRing of the ConsistentHash mode
+
+	loadLock sync.Mutex           // guards loads
+	loads    map[string]*loadCall // Loader calls in flight by key
+
+	hookLock    sync.RWMutex // guards the hooks and the janitor below
+	onExpire    []func(key string, value interface{})
+	janitorStop chan struct{}
+	memoryStop  chan struct{} // stops the watcher started by StartMemoryWatcher
+	evictions   evictionLog
+	drained     drainSignal                       // see WaitEmpty
+	indexes     indexSet                          // see AddIndex
+	keyLocks    [DEFAULT_SHARD_COUNT]keyLockShard // see LockKey
+	iterSlots   chan struct{}                     // semaphore of the MaxIterGoroutines mode, nil otherwise
+	opts        ConcurrentMapStringOpts
 }
 
 // A "thread" safe string to anything map.
 type concurrentMapSharedString struct {
-	items map[string]interface{}
-	sync.RWMutex // Read Write mutex, guards access to internal map.
+	count    int64                      // len(items), maintained atomically so that Count() needs no lock. Keep it first for 64-bit alignment.
+	items    map[string]interface{}     // allocated on the first write, so that unused shards cost little. Access it through lookup, put, del and the other accessors
+	small    []smallEntry               // the entries sorted by key while items is nil, see SmallShardSize
+	smallMax int                        // SmallShardSize of the map
+	reserved int                        // capacity items was allocated with by Reserve, 0 if unknown
+	retired  bool                       // set once the shard has been swapped out of tables, writers must retry on the new tables
+	expires  map[string]time.Time       // deadlines of the keys set with a TTL, allocated on first use
+	freqs    map[string]*uint32         // access counters of the LFU mode, nil otherwise
+	types    map[string]reflect.Type    // type of the first value stored under each key in the TypeGuard mode, nil otherwise
+	metas    map[string]entryMeta       // timestamps of the entries in the TrackMeta mode, nil otherwise
+	order    *list.List                 // keys in insertion order in the Ordered mode, nil otherwise
+	orderIdx map[string]*list.Element   // element of each key in order
+	waiters  map[string][]chan struct{} // channels of the WaitForKey callers blocked on absent keys, closed by set
+	lent     []map[string]interface{}   // copies of items handed to the last WithShard callbacks in the DebugLeaks mode, poisoned after they returned
+	subs     []int                      // tables indexes of the sub-shards this hot shard was split into, it keeps the first part of its keys itself
+	drained  *drainSignal               // of the map, notified when the shard becomes empty
+	indexes  *indexSet                  // secondary indexes of the map, kept up to date by set and remove
+	clock    Clock                      // of the map, for the timestamps of the TrackMeta mode
+	rwLocker                            // Read Write lock, guards access to internal map.
+}
+
+// Stores value under key and reports whether key is new, the write lock MUST be held.
+func (shard *concurrentMapSharedString) set(key string, value interface{}) bool {
+	old, exists := shard.lookup(key)
+	if exists {
+		shard.indexes.drop(key, old)
+	}
+	shard.indexes.add(key, value)
+	if !exists {
+		atomic.AddInt64(&shard.count, 1)
+		if shard.freqs != nil {
+			shard.freqs[key] = new(uint32)
+		}
+		if shard.types != nil {
+			shard.types[key] = valueType(value)
+		}
+		if shard.order != nil {
+			shard.orderIdx[key] = shard.order.PushBack(key)
+		}
+	}
+	shard.put(key, value)
+	if shard.metas != nil {
+		now := shard.now()
+		meta, ok := shard.metas[key]
+		if !ok {
+			meta.created = now
+		}
+		meta.updated = now
+		shard.metas[key] = meta
+	}
+	if shard.expires != nil {
+		delete(shard.expires, key)
+	}
+	if chs, ok := shard.waiters[key]; ok {
+		for _, ch := range chs {
+			close(ch)
+		}
+		delete(shard.waiters, key)
+	}
+	return !exists
+}
+
+// Returns the current time of the clock of the map.
+func (shard *concurrentMapSharedString) now() time.Time {
+	if shard.clock == nil {
+		return time.Now()
+	}
+	return shard.clock.Now()
+}
+
+// Marks the shard as swapped out of tables and wakes up all its WaitForKey
+// callers, so that they retry on the new shards. The write lock MUST be held.
+func (shard *concurrentMapSharedString) retire() {
+	shard.retired = true
+	for key, chs := range shard.waiters {
+		for _, ch := range chs {
+			close(ch)
+		}
+		delete(shard.waiters, key)
+	}
+}
+
+// Swaps in items as the contents of the shard and returns the old ones, the
+// bookkeeping of the old keys is dropped. The write lock MUST be held.
+func (shard *concurrentMapSharedString) replace(items map[string]interface{}) map[string]interface{} {
+	shard.indexes.dropAll(shard)
+	old := shard.itemsMap()
+	shard.setItems(items)
+	shard.indexes.addAll(shard)
+	shard.reserved = 0
+	atomic.StoreInt64(&shard.count, int64(len(items)))
+	if len(items) == 0 {
+		shard.drained.notify()
+	}
+	shard.expires = nil
+	if shard.freqs != nil {
+		shard.freqs = make(map[string]*uint32, len(items))
+		for key := range items {
+			shard.freqs[key] = new(uint32)
+		}
+	}
+	if shard.types != nil {
+		shard.types = make(map[string]reflect.Type, len(items))
+		for key, value := range items {
+			shard.types[key] = valueType(value)
+		}
+	}
+	if shard.metas != nil {
+		now := shard.now()
+		shard.metas = make(map[string]entryMeta, len(items))
+		for key := range items {
+			shard.metas[key] = entryMeta{created: now, updated: now}
+		}
+	}
+	if shard.order != nil {
+		// items has no order of its own, keys are ordered as ranging over it yields them
+		shard.order = list.New()
+		shard.orderIdx = make(map[string]*list.Element, len(items))
+		for key := range items {
+			shard.orderIdx[key] = shard.order.PushBack(key)
+		}
+	}
+	return old
+}
+
+// Brings the bookkeeping in line with items after they were modified directly,
+// new keys count as inserted now. The write lock MUST be held.
+func (shard *concurrentMapSharedString) resync() {
+	atomic.StoreInt64(&shard.count, int64(shard.size()))
+	if shard.size() == 0 {
+		shard.drained.notify()
+	}
+	for key := range shard.expires {
+		if _, ok := shard.lookup(key); !ok {
+			delete(shard.expires, key)
+		}
+	}
+	if shard.freqs != nil {
+		for key := range shard.freqs {
+			if _, ok := shard.lookup(key); !ok {
+				delete(shard.freqs, key)
+			}
+		}
+		shard.rangeItems(func(key string, _ interface{}) bool {
+			if _, ok := shard.freqs[key]; !ok {
+				shard.freqs[key] = new(uint32)
+			}
+			return true
+		})
+	}
+	if shard.types != nil {
+		for key := range shard.types {
+			if _, ok := shard.lookup(key); !ok {
+				delete(shard.types, key)
+			}
+		}
+		shard.rangeItems(func(key string, value interface{}) bool {
+			if _, ok := shard.types[key]; !ok {
+				shard.types[key] = valueType(value)
+			}
+			return true
+		})
+	}
+	if shard.metas != nil {
+		now := shard.now()
+		for key := range shard.metas {
+			if _, ok := shard.lookup(key); !ok {
+				delete(shard.metas, key)
+			}
+		}
+		shard.rangeItems(func(key string, _ interface{}) bool {
+			if _, ok := shard.metas[key]; !ok {
+				shard.metas[key] = entryMeta{created: now, updated: now}
+			}
+			return true
+		})
+	}
+	if shard.order != nil {
+		for key, e := range shard.orderIdx {
+			if _, ok := shard.lookup(key); !ok {
+				shard.order.Remove(e)
+				delete(shard.orderIdx, key)
+			}
+		}
+		shard.rangeItems(func(key string, _ interface{}) bool {
+			if _, ok := shard.orderIdx[key]; !ok {
+				shard.orderIdx[key] = shard.order.PushBack(key)
+			}
+			return true
+		})
+	}
+}
+
+// Calls fn for every entry until it returns false, in insertion order in the
+// Ordered mode and in random order otherwise. The lock MUST be held.
+func (shard *concurrentMapSharedString) each(fn func(key string, value interface{}) bool) {
+	if shard.order != nil {
+		for e := shard.order.Front(); e != nil; e = e.Next() {
+			key := e.Value.(string)
+			value, _ := shard.lookup(key)
+			if !fn(key, value) {
+				return
+			}
+		}
+		return
+	}
+	shard.rangeItems(fn)
+}
+
+// Calls fn for every entry of shard like each, with the original values of the
+// compressed ones (see CompressThreshold). The lock MUST be held.
+func (m *ConcurrentMapString) eachPlain(shard *concurrentMapSharedString, fn func(key string, value interface{}) bool) {
+	if m.opts.CompressThreshold <= 0 {
+		shard.each(fn)
+		return
+	}
+	shard.each(func(key string, value interface{}) bool {
+		return fn(key, m.Uncompress(value))
+	})
+}
+
+// Copies key together with its bookkeeping into dst, the locks of both shards MUST be held.
+func (shard *concurrentMapSharedString) copyEntry(key string, dst *concurrentMapSharedString) {
+	value, _ := shard.lookup(key)
+	dst.set(key, value)
+	if deadline, ok := shard.expires[key]; ok {
+		if dst.expires == nil {
+			dst.expires = make(map[string]time.Time)
+		}
+		dst.expires[key] = deadline
+	}
+	if freq, ok := shard.freqs[key]; ok && dst.freqs != nil {
+		*dst.freqs[key] = *freq
+	}
+	if meta, ok := shard.metas[key]; ok && dst.metas != nil {
+		dst.metas[key] = meta
+	}
+}
+
+// Deletes key and returns its old value, the write lock MUST be held.
+func (shard *concurrentMapSharedString) remove(key string) (interface{}, bool) {
+	v, ok := shard.lookup(key)
+	if ok {
+		shard.indexes.drop(key, v)
+		shard.del(key)
+		if atomic.AddInt64(&shard.count, -1) == 0 {
+			shard.drained.notify()
+		}
+		if shard.expires != nil {
+			delete(shard.expires, key)
+		}
+		if shard.freqs != nil {
+			delete(shard.freqs, key)
+		}
+		if shard.types != nil {
+			delete(shard.types, key)
+		}
+		if shard.metas != nil {
+			delete(shard.metas, key)
+		}
+		if shard.order != nil {
+			shard.order.Remove(shard.orderIdx[key])
+			delete(shard.orderIdx, key)
+		}
+	}
+	return v, ok
 }
 
 // Creates a new concurrent map.
 func NewConcurrentMapString(shardCount int) *ConcurrentMapString {
-	if shardCount <= 0 {
-		shardCount = DEFAULT_SHARD_COUNT
+	return NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: shardCount})
+}
+
+// Creates a new concurrent map whose shard count matches the parallelism of
+// the machine, see autoShardCount.
+func NewConcurrentMapStringAuto() *ConcurrentMapString {
+	return NewConcurrentMapString(autoShardCount(runtime.GOMAXPROCS(0)))
+}
+
+const (
+	minAutoShardCount = 8
+	maxAutoShardCount = 1024
+)
+
+// Returns the smallest power of two not below 4*procs, clamped to
+// [minAutoShardCount, maxAutoShardCount]. 4 shards per thread keep the chance
+// of two threads contending for the same shard low, more only cost memory.
+func autoShardCount(procs int) int {
+	count := minAutoShardCount
+	for count < 4*procs && count < maxAutoShardCount {
+		count *= 2
 	}
-	rect := ConcurrentMapString{
-		shard_count: shardCount,
+	return count
+}
+
+// Creates a new concurrent map with the given options.
+func NewConcurrentMapStringWithOpts(opts ConcurrentMapStringOpts) *ConcurrentMapString {
+	rawKeys := opts.KeyNormalizer == nil && opts.Hasher == nil && opts.Seed == 0
+	opts.Init()
+	rect := &ConcurrentMapString{
+		base:    opts.ShardCount,
+		rawKeys: rawKeys,
+		opts:    opts,
 	}
+	rect.tables = rect.newShards(opts.ShardCount)
+	if opts.MaxIterGoroutines > 0 {
+		rect.iterSlots = make(chan struct{}, opts.MaxIterGoroutines)
+	}
+	return rect
+}
+
+// Creates the shards, leaving their items nil until the first write, so that a
+// huge shard count costs one allocation of the shard headers rather than a map
+// per shard up front. Reading a nil map is fine, writers allocate it under the
+// shard lock (see put). With SmallShardSize the entries start in a sorted
+// slice instead, see concurrent_map_small.go.
+func newSharedStrings(shardCount int, opts *ConcurrentMapStringOpts) []*concurrentMapSharedString {
+	shards := make([]concurrentMapSharedString, shardCount)
 	m := make([]*concurrentMapSharedString, shardCount)
 	for i := 0; i < shardCount; i++ {
-		m[i] = &concurrentMapSharedString{items: make(map[string]interface{})}
+		m[i] = &shards[i]
+		m[i].rwLocker = newLocker(opts)
+		m[i].clock = opts.Clock
+		m[i].smallMax = opts.SmallShardSize
+		if opts.LFUCapacity > 0 {
+			m[i].freqs = make(map[string]*uint32)
+		}
+		if opts.TypeGuard {
+			m[i].types = make(map[string]reflect.Type)
+		}
+		if opts.TrackMeta {
+			m[i].metas = make(map[string]entryMeta)
+		}
+		if opts.Ordered {
+			m[i].order = list.New()
+			m[i].orderIdx = make(map[string]*list.Element)
+		}
+	}
+	return m
+}
+
+// Creates shardCount shards for m.
+func (m *ConcurrentMapString) newShards(shardCount int) []*concurrentMapSharedString {
+	shards := newSharedStrings(shardCount, &m.opts)
+	for _, shard := range shards {
+		shard.drained = &m.drained
+		shard.indexes = &m.indexes
+	}
+	return shards
+}
+
+// Returns the current shards. They may be retired by a concurrent ReplaceAll,
+// readers can still iterate them as a complete view of the old contents.
+// A zero-value ConcurrentMapString is initialized here on first use.
+func (m *ConcurrentMapString) shards() []*concurrentMapSharedString {
+	tables, _ := m.layout()
+	return tables
+}
+
+// Returns the current shards along with the number of them addressed by the
+// hash, as needed by locate. Outside of the methods holding m.lock, tables and
+// base MUST only be read through it: ReplaceAll, Resize and hot shard splits
+// swap in a new slice under m.lock and never modify a published one, so the
+// slice returned stays intact. It may go stale, but its retired shards keep
+// their entries, hence iterating it yields the map as it was before the swap.
+func (m *ConcurrentMapString) layout() ([]*concurrentMapSharedString, int) {
+	m.checkNil()
+	m.lock.RLock()
+	tables, base := m.tables, m.base
+	m.lock.RUnlock()
+	if tables == nil {
+		m.lock.Lock()
+		m.lazyInit()
+		tables, base = m.tables, m.base
+		m.lock.Unlock()
+	}
+	return tables, base
+}
+
+// Fills in the default options and DEFAULT_SHARD_COUNT shards if the map was
+// not created by a constructor, m.lock MUST be held for writing.
+func (m *ConcurrentMapString) lazyInit() {
+	if m.tables == nil {
+		m.rawKeys = m.opts.KeyNormalizer == nil && m.opts.Hasher == nil && m.opts.Seed == 0
+		m.opts.Init()
+		m.tables = m.newShards(m.opts.ShardCount)
+		m.base = m.opts.ShardCount
+		if m.opts.MaxIterGoroutines > 0 {
+			m.iterSlots = make(chan struct{}, m.opts.MaxIterGoroutines)
+		}
 	}
-	rect.tables = m
-	return &rect
 }
 
 // Returns shard under given key
 func (m *ConcurrentMapString) GetShard(key string) *concurrentMapSharedString {
-	return m.tables[uint(fnv32(key))%uint(m.shard_count)]
+	return m.shardOf(m.normalize(key))
+}
+
+// Returns shard under the already normalized key.
+func (m *ConcurrentMapString) shardOf(key string) *concurrentMapSharedString {
+	tables, base := m.layout()
+	return tables[m.locate(key, tables, base)]
+}
+
+// Returns the index in tables of the shard owning the normalized key, following
+// the split of a hot shard into its sub-shards. base belongs to tables.
+func (m *ConcurrentMapString) locate(key string, tables []*concurrentMapSharedString, base int) int {
+	if atomic.LoadInt32(&m.pinCount) > 0 {
+		if idx, ok := m.pins.Load(key); ok && idx.(int) < len(tables) {
+			return idx.(int)
+		}
+	}
+	return m.locateHash(m.opts.Hasher(key), tables, base)
+}
+
+// Like locate, given the hash of a key which is not pinned.
+func (m *ConcurrentMapString) locateHash(hash uint32, tables []*concurrentMapSharedString, base int) int {
+	idx := m.indexOfHash(hash, base)
+	if subs := tables[idx].subs; subs != nil {
+		//a secondary hash, the primary one is the same for all keys of the shard
+		if sub := mix32(hash) % uint32(len(subs)+1); sub > 0 {
+			idx = subs[sub-1]
+		}
+	}
+	return idx
+}
+
+// Returns the index of the shard the normalized key belongs to among shardCount
+// shards addressed by the hash, not taking split hot shards into account.
+func (m *ConcurrentMapString) indexOf(key string, shardCount int) int {
+	return m.indexOfHash(m.opts.Hasher(key), shardCount)
+}
+
+func (m *ConcurrentMapString) indexOfHash(hash uint32, shardCount int) int {
+	if m.opts.ConsistentHash {
+		return m.ringOf(shardCount).get(hash)
+	}
+	return int(uint(hash) % uint(shardCount))
+}
+
+// Returns the index of the shard key is placed in. Placement only depends on
+// the key, the options and the shard count, so with DeterministicHasher it is
+// reproducible across processes and versions.
+func (m *ConcurrentMapString) GetShardIndex(key string) int {
+	tables, base := m.layout()
+	return m.locate(m.normalize(key), tables, base)
+}
+
+// Returns how many of keys land in each shard index, using the hasher and
+// shard count of m. The map itself is not touched, so a key scheme can be
+// checked for collisions before loading data.
+func (m *ConcurrentMapString) HashDistribution(keys []string) map[int]int {
+	tables, base := m.layout()
+	dist := make(map[int]int)
+	for _, key := range keys {
+		dist[m.locate(m.normalize(key), tables, base)]++
+	}
+	return dist
+}
+
+// Returns the shard under key with its write lock held.
+func (m *ConcurrentMapString) lockShard(key string) *concurrentMapSharedString {
+	for {
+		shard := m.shardOf(key)
+		shard.Lock()
+		if !shard.retired {
+			return shard
+		}
+		shard.Unlock()
+	}
+}
+
+// Returns the shard under key with its read lock held.
+func (m *ConcurrentMapString) rlockShard(key string) *concurrentMapSharedString {
+	for {
+		shard := m.shardOf(key)
+		shard.RLock()
+		if !shard.retired {
+			return shard
+		}
+		shard.RUnlock()
+	}
+}
+
+// Write locks the distinct shards owning the normalized keys in ascending index
+// order, which is the lock order every multi-shard operation MUST follow to
+// avoid deadlocks. Returns the shard of each key, which MUST be used instead of
+// looking them up again while the locks are held. Release them with unlockShards.
+func (m *ConcurrentMapString) lockShards(keys []string) ([]*concurrentMapSharedString, []*concurrentMapSharedString) {
+	for {
+		tables, base := m.layout()
+		owners := make([]*concurrentMapSharedString, len(keys))
+		seen := make(map[int]bool, len(keys))
+		indexes := make([]int, 0, len(keys))
+		for i, key := range keys {
+			idx := m.locate(key, tables, base)
+			owners[i] = tables[idx]
+			if !seen[idx] {
+				seen[idx] = true
+				indexes = append(indexes, idx)
+			}
+		}
+		sort.Ints(indexes)
+		locked := make([]*concurrentMapSharedString, 0, len(indexes))
+		retired := false
+		for _, idx := range indexes {
+			shard := tables[idx]
+			shard.Lock()
+			locked = append(locked, shard)
+			if shard.retired {
+				retired = true
+				break
+			}
+		}
+		if !retired {
+			return owners, locked
+		}
+		unlockShards(locked)
+	}
+}
+
+// Groups the normalized keys by shard and calls fn once per shard with its
+// keys, while holding the write (or read) lock of that shard. Shards are
+// visited in ascending index order, one at a time.
+func (m *ConcurrentMapString) withShardsOf(keys []string, write bool, fn func(shard *concurrentMapSharedString, keys []string)) {
+	tables, base := m.layout()
+	groups := make(map[int][]string)
+	for _, key := range keys {
+		idx := m.locate(key, tables, base)
+		groups[idx] = append(groups[idx], key)
+	}
+	indexes := make([]int, 0, len(groups))
+	for idx := range groups {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+	var retired []string
+	for _, idx := range indexes {
+		shard := tables[idx]
+		if write {
+			shard.Lock()
+		} else {
+			shard.RLock()
+		}
+		if shard.retired {
+			retired = append(retired, groups[idx]...)
+		} else {
+			fn(shard, groups[idx])
+		}
+		if write {
+			shard.Unlock()
+		} else {
+			shard.RUnlock()
+		}
+	}
+	if len(retired) > 0 {
+		m.withShardsOf(retired, write, fn)
+	}
+}
+
+func unlockShards(shards []*concurrentMapSharedString) {
+	for _, shard := range shards {
+		shard.Unlock()
+	}
+}
+
+// Panics with a message naming the constructor if m is nil, rather than with
+// the nil pointer dereference of whichever field is read first. The methods
+// reading the options before normalize or layout call it upfront.
+func (m *ConcurrentMapString) checkNil() {
+	if m == nil {
+		panic("util: nil *ConcurrentMapString, create it with NewConcurrentMapString")
+	}
+}
+
+// Returns the form of key which is actually stored in the map.
+func (m *ConcurrentMapString) normalize(key string) string {
+	m.checkNil()
+	if m.opts.KeyNormalizer == nil {
+		return key
+	}
+	return m.opts.KeyNormalizer(key)
 }
 
 func (m *ConcurrentMapString) MSet(data map[string]interface{}) {
+	m.checkNil()
+	if m.opts.TrackMetrics {
+		atomic.AddInt64(&m.ops.sets, int64(len(data)))
+	}
+	for key, value := range data {
+		value = m.compress(value)
+		key = m.normalize(key)
+		room := m.room()
+		shard := m.lockShard(key)
+		inserted, err := m.store(shard, key, value, &room)
+		shard.Unlock()
+		if err == nil && inserted {
+			m.afterInsert(key)
+		}
+	}
+}
+
+// Replaces the whole contents of the map with data.
+// The new shards are built aside and swapped in at once, so readers see either
+// the old or the new data set, never a partial one. Writes racing with ReplaceAll
+// are retried on the new shards.
+func (m *ConcurrentMapString) ReplaceAll(data map[string]interface{}) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.lazyInit()
+	tables := m.newShards(m.base)
 	for key, value := range data {
-		shard := m.GetShard(key)
+		key = m.normalize(key)
+		m.store(tables[m.locate(key, tables, len(tables))], key, value, nil)
+	}
+	for _, shard := range m.tables {
+		shard.Lock()
+		shard.indexes.dropAll(shard)
+		shard.retire()
+		shard.Unlock()
+	}
+	for _, shard := range tables {
+		//dropping the old entries unindexed the keys kept with the same indexed value
+		shard.indexes.addAll(shard)
+	}
+	m.tables = tables
+	if len(data) == 0 {
+		m.drained.notify()
+	}
+}
+
+// Redistributes all entries into shardCount shards. Every shard is locked while
+// its entries are copied, so concurrent operations block until the new shards
+// are swapped in and then retry on them.
+func (m *ConcurrentMapString) Resize(shardCount int) {
+	if shardCount <= 0 {
+		shardCount = DEFAULT_SHARD_COUNT
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.lazyInit()
+	tables := m.newShards(shardCount)
+	for _, shard := range m.tables {
+		shard.Lock()
+	}
+	for _, shard := range m.tables {
+		src := shard
+		src.each(func(key string, value interface{}) bool {
+			src.copyEntry(key, tables[m.locate(key, tables, shardCount)])
+			return true
+		})
+		shard.retire()
+	}
+	for _, shard := range m.tables {
+		shard.Unlock()
+	}
+	m.tables = tables
+	m.base = shardCount
+}
+
+// Grows the shards so that totalExpected entries spread evenly over them fit
+// without rehashing, e.g. before a bulk load into a map which was cleared or
+// created small. A shard which may have less room is reallocated with the
+// capacity and its entries are copied over under its write lock. Go maps
+// never shrink and do not report their capacity, so a shard counts as big
+// enough if it holds that many entries or was reserved for them before.
+// Shards stay in the SmallShardSize representation if that many entries fit.
+func (m *ConcurrentMapString) Reserve(totalExpected int) {
+	tables, base := m.layout()
+	perShard := totalExpected / base
+	for _, shard := range tables {
+		shard.Lock()
+		if !shard.retired && shard.size() < perShard && shard.reserved < perShard && perShard > shard.smallMax {
+			shard.promote(perShard)
+			shard.reserved = perShard
+		}
+		shard.Unlock()
+	}
+}
+
+// Returns the keys which are not stored in the shard the current hasher places
+// them in, e.g. after the hasher was swapped. Such keys are invisible to Get.
+func (m *ConcurrentMapString) VerifyPlacement() []string {
+	tables, base := m.layout()
+	var misplaced []string
+	for i, shard := range tables {
+		shard.RLock()
+		shard.rangeItems(func(key string, _ interface{}) bool {
+			if m.locate(key, tables, base) != i {
+				misplaced = append(misplaced, key)
+			}
+			return true
+		})
+		shard.RUnlock()
+	}
+	return misplaced
+}
+
+// Moves the keys reported by VerifyPlacement to their correct shards and
+// returns how many were moved. If the correct shard already holds the key its
+// value wins and the misplaced copy is dropped. All shards are locked meanwhile.
+func (m *ConcurrentMapString) RepairPlacement() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.lazyInit()
+	for _, shard := range m.tables {
 		shard.Lock()
-		shard.items[key] = value
+	}
+	moved := 0
+	for i, shard := range m.tables {
+		var misplaced []string
+		shard.rangeItems(func(key string, _ interface{}) bool {
+			if m.locate(key, m.tables, m.base) != i {
+				misplaced = append(misplaced, key)
+			}
+			return true
+		})
+		for _, key := range misplaced {
+			dst := m.tables[m.locate(key, m.tables, m.base)]
+			if _, ok := dst.lookup(key); !ok {
+				shard.copyEntry(key, dst)
+				moved++
+			}
+			shard.remove(key)
+			//which unindexed the copy in dst too if the indexed value is the same
+			value, _ := dst.lookup(key)
+			dst.indexes.add(key, value)
+		}
+	}
+	for _, shard := range m.tables {
 		shard.Unlock()
 	}
+	return moved
 }
 
 // Sets the given value under the specified key.
+// Values rejected by MaxValueBytes, TypeGuard or MaxEntries are dropped, use SetChecked to be told about it.
 func (m *ConcurrentMapString) Set(key string, value interface{}) {
+	m.SetChecked(key, value)
+}
+
+// Sets the given value under the specified key, unless it is larger than
+// MaxValueBytes, is rejected by TypeGuard or is a new key while the map holds
+// MaxEntries entries, in which case the map is left unchanged and an error is
+// returned.
+func (m *ConcurrentMapString) SetChecked(key string, value interface{}) error {
+	m.checkNil()
+	if m.opts.TrackMetrics {
+		atomic.AddInt64(&m.ops.sets, 1)
+	}
+	if err := m.checkSize(key, value); err != nil {
+		return err
+	}
+	value = m.compress(value)
+	key = m.normalize(key)
+	room := m.room()
 	// Get map shard.
-	shard := m.GetShard(key)
-	shard.Lock()
-	shard.items[key] = value
+	shard := m.lockShard(key)
+	inserted, err := m.store(shard, key, value, &room)
 	shard.Unlock()
+	if inserted {
+		m.afterInsert(key)
+	}
+	return err
+}
+
+// Reports whether storing value has to remove the key instead, see RejectNil.
+func (m *ConcurrentMapString) rejectsNil(value interface{}) bool {
+	return value == nil && m.opts.RejectNil
+}
+
+// Returns how many keys may still be inserted before the map holds MaxEntries
+// entries, -1 if there is no limit. It is computed before the shard locks are
+// taken, as Count may not be called with a shard locked.
+func (m *ConcurrentMapString) room() int {
+	if m.opts.MaxEntries <= 0 {
+		return -1
+	}
+	if room := m.opts.MaxEntries - m.Count(); room > 0 {
+		return room
+	}
+	return 0
+}
+
+// Rejects inserting key into the shard once room, as returned by m.room, is
+// used up; inserting it uses one. Updates of the existing keys are allowed, a
+// nil room means the caller only updates existing keys. The write lock MUST be held.
+func (m *ConcurrentMapString) checkCapacity(shard *concurrentMapSharedString, key string, room *int) error {
+	if room == nil || *room < 0 {
+		return nil
+	}
+	if _, ok := shard.lookup(key); ok {
+		return nil
+	}
+	if *room == 0 {
+		return fmt.Errorf("%w: cannot insert %s, limit %d", ErrMapFull, key, m.opts.MaxEntries)
+	}
+	*room--
+	return nil
+}
+
+// Stores value under key in the locked shard unless TypeGuard or MaxEntries
+// rejects it, see checkCapacity for room; a nil value removes the key instead
+// in the RejectNil mode. Large values are compressed in the CompressThreshold
+// mode, callers which may do it before locking should. Every method storing a
+// value of the caller goes through it. Reports whether key is new. The write
+// lock MUST be held.
+func (m *ConcurrentMapString) store(shard *concurrentMapSharedString, key string, value interface{}, room *int) (bool, error) {
+	if m.rejectsNil(value) {
+		shard.remove(key)
+		return false, nil
+	}
+	value = m.compress(value)
+	if err := m.checkType(shard, key, value); err != nil {
+		return false, err
+	}
+	if err := m.checkCapacity(shard, key, room); err != nil {
+		return false, err
+	}
+	return shard.set(key, value), nil
+}
+
+// Checks value against MaxValueBytes.
+func (m *ConcurrentMapString) checkSize(key string, value interface{}) error {
+	if m.opts.MaxValueBytes <= 0 {
+		return nil
+	}
+	if size := m.opts.Sizer(value); size > m.opts.MaxValueBytes {
+		return fmt.Errorf("%w: value of %s has %d bytes, limit %d", ErrValueTooLarge, key, size, m.opts.MaxValueBytes)
+	}
+	return nil
+}
+
+// Checks that value has the type of the first value stored under key, in the
+// TypeGuard mode. Panics instead of returning the error if TypeGuardPanic is set.
+// The lock of shard MUST be held.
+func (m *ConcurrentMapString) checkType(shard *concurrentMapSharedString, key string, value interface{}) error {
+	if shard.types == nil {
+		return nil
+	}
+	t, ok := shard.types[key]
+	if !ok || t == valueType(value) {
+		return nil
+	}
+	err := fmt.Errorf("%w: value of %s has type %v, %v expected", ErrTypeMismatch, key, valueType(value), t)
+	if m.opts.TypeGuardPanic {
+		panic(err)
+	}
+	return err
 }
 
 // Callback to return new element to be inserted into the map
@@ -68,81 +938,650 @@ func (m *ConcurrentMapString) Set(key string, value interface{}) {
 type UpsertCb func(exist bool, valueInMap interface{}, newValue interface{}) interface{}
 
 // Insert or Update - updates existing element or inserts a new one using UpsertCb
+// If the result is rejected by TypeGuard or MaxEntries the map is left unchanged and the value in the map is returned.
 func (m *ConcurrentMapString) Upsert(key string, value interface{}, cb UpsertCb) (res interface{}) {
-	shard := m.GetShard(key)
-	shard.Lock()
-	v, ok := shard.items[key]
+	key = m.normalize(key)
+	room := m.room()
+	shard := m.lockShard(key)
+	v, ok := shard.lookup(key)
+	v = m.Uncompress(v)
 	res = cb(ok, v, value)
-	shard.items[key] = res
+	inserted, err := m.store(shard, key, res, &room)
 	shard.Unlock()
+	if err != nil {
+		return v
+	}
+	if inserted {
+		m.afterInsert(key)
+	}
 	return res
 }
 
+// Calls fn with the value under key and whether it exists, and stores the
+// value fn returns only if store is true. Unlike Upsert, fn can decide to leave
+// the entry untouched. Returns the value under key after the call and whether
+// it was stored; it is the old value (nil if missing) when nothing was stored.
+// fn is called while the shard is locked, so it must not access the map.
+func (m *ConcurrentMapString) Update(key string, fn func(old interface{}, exists bool) (newValue interface{}, store bool)) (interface{}, bool) {
+	key = m.normalize(key)
+	room := m.room()
+	shard := m.lockShard(key)
+	v, ok := shard.lookup(key)
+	v = m.Uncompress(v)
+	res, store := fn(v, ok)
+	if !store {
+		shard.Unlock()
+		return v, false
+	}
+	inserted, err := m.store(shard, key, res, &room)
+	shard.Unlock()
+	if err != nil {
+		return v, false
+	}
+	if inserted {
+		m.afterInsert(key)
+	}
+	return res, true
+}
+
+// Adds delta to the int64 counter under key only if the result does not exceed
+// max, e.g. to enforce a quota. A missing key counts as 0. Returns the value
+// after the call and whether delta was applied. A value under key which is not
+// an int64 is left untouched and reported as 0, not applied. A missing key is
+// not created while the map holds MaxEntries entries.
+func (m *ConcurrentMapString) IncrementBounded(key string, delta, max int64) (int64, bool) {
+	key = m.normalize(key)
+	room := m.room()
+	shard := m.lockShard(key)
+	v, ok := shard.lookup(key)
+	current, isInt := v.(int64)
+	if ok && !isInt {
+		shard.Unlock()
+		return 0, false
+	}
+	if current+delta > max {
+		shard.Unlock()
+		return current, false
+	}
+	inserted, err := m.store(shard, key, current+delta, &room)
+	shard.Unlock()
+	if err != nil {
+		return current, false
+	}
+	if inserted {
+		m.afterInsert(key)
+	}
+	return current + delta, true
+}
+
+// Appends values to the []interface{} stored under key, creating the slice if
+// the key is absent. If the existing value is not a []interface{} it is left
+// untouched and an error is returned, rather than silently replacing it. So is
+// ErrMapFull for a missing key while the map holds MaxEntries entries.
+func (m *ConcurrentMapString) Append(key string, values ...interface{}) error {
+	key = m.normalize(key)
+	room := m.room()
+	shard := m.lockShard(key)
+	v, ok := shard.lookup(key)
+	if !ok {
+		inserted, err := m.store(shard, key, append([]interface{}{}, values...), &room)
+		shard.Unlock()
+		if inserted {
+			m.afterInsert(key)
+		}
+		return err
+	}
+	defer shard.Unlock()
+	list, isList := v.([]interface{})
+	if !isList {
+		return fmt.Errorf("%w: value of %s is not []interface{}", ErrTypeMismatch, key)
+	}
+	shard.set(key, append(list, values...))
+	return nil
+}
+
+// Sets field of the map[string]interface{} record stored under key.
+// Returns false if the key is missing or its value is not a map[string]interface{}.
+func (m *ConcurrentMapString) UpdateField(key, field string, value interface{}) bool {
+	key = m.normalize(key)
+	shard := m.lockShard(key)
+	defer shard.Unlock()
+	v, ok := shard.lookup(key)
+	if !ok {
+		return false
+	}
+	record, isRecord := v.(map[string]interface{})
+	if !isRecord {
+		return false
+	}
+	//the index keys may derive from the field, reindex around the in place update
+	shard.indexes.drop(key, record)
+	record[field] = value
+	shard.indexes.add(key, record)
+	return true
+}
+
+// Stores new under key if its current value is expected, compared with ==.
+// Values MUST be comparable, use CompareAndSwapFunc for slices or maps.
+func (m *ConcurrentMapString) CompareAndSwap(key string, expected, new interface{}) bool {
+	return m.CompareAndSwapFunc(key, expected, new, func(a, b interface{}) bool {
+		return a == b
+	})
+}
+
+// Stores new under key if eq reports its current value equal to expected,
+// which allows CAS on non-comparable values (e.g. with reflect.DeepEqual).
+// eq is called with the shard lock held. Returns false if key is absent.
+func (m *ConcurrentMapString) CompareAndSwapFunc(key string, expected, new interface{}, eq func(a, b interface{}) bool) bool {
+	key = m.normalize(key)
+	shard := m.lockShard(key)
+	defer shard.Unlock()
+	v, ok := shard.lookup(key)
+	if !ok || !eq(m.Uncompress(v), expected) {
+		return false
+	}
+	_, err := m.store(shard, key, new, nil)
+	return err == nil
+}
+
+// Used by CompareAndSwapMany, New is stored under Key if its value is still Old.
+type CasTuple struct {
+	Key string
+	Old interface{}
+	New interface{}
+}
+
+// Applies all the updates only if every key is present and still holds its Old
+// value (compared with ==, so values MUST be comparable) and every New value
+// passes TypeGuard, otherwise nothing is changed and false is returned. All
+// involved shards are locked at once.
+func (m *ConcurrentMapString) CompareAndSwapMany(updates []CasTuple) bool {
+	keys := make([]string, len(updates))
+	for i, update := range updates {
+		keys[i] = m.normalize(update.Key)
+	}
+	owners, locked := m.lockShards(keys)
+	defer unlockShards(locked)
+	for i, update := range updates {
+		v, ok := owners[i].lookup(keys[i])
+		if !ok || m.Uncompress(v) != update.Old {
+			return false
+		}
+		if !m.rejectsNil(update.New) && m.checkType(owners[i], keys[i], m.compress(update.New)) != nil {
+			return false
+		}
+	}
+	for i, update := range updates {
+		m.store(owners[i], keys[i], update.New, nil)
+	}
+	return true
+}
+
+// Returns the nested map stored under key, creating and storing a new one with
+// shardCount shards if the key is absent, so that two-level maps can be built
+// concurrently. Returns nil if the value under key is not a *ConcurrentMapString
+// or the key is absent while the map holds MaxEntries entries.
+func (m *ConcurrentMapString) GetOrCreateSubMap(key string, shardCount int) *ConcurrentMapString {
+	key = m.normalize(key)
+	room := m.room()
+	shard := m.lockShard(key)
+	if v, ok := shard.lookup(key); ok {
+		shard.Unlock()
+		sub, _ := v.(*ConcurrentMapString)
+		return sub
+	}
+	sub := NewConcurrentMapString(shardCount)
+	_, err := m.store(shard, key, sub, &room)
+	shard.Unlock()
+	if err != nil {
+		return nil
+	}
+	m.afterInsert(key)
+	return sub
+}
+
 // Sets the given value under the specified key if no value was associated with it.
+// Reports whether it was set, values rejected by TypeGuard or MaxEntries are not.
 func (m *ConcurrentMapString) SetIfAbsent(key string, value interface{}) bool {
+	key = m.normalize(key)
+	room := m.room()
 	// Get map shard.
-	shard := m.GetShard(key)
-	shard.Lock()
-	_, ok := shard.items[key]
-	if !ok {
-		shard.items[key] = value
+	shard := m.lockShard(key)
+	inserted := false
+	if _, ok := shard.lookup(key); !ok {
+		inserted, _ = m.store(shard, key, value, &room)
+	}
+	shard.Unlock()
+	if inserted {
+		m.afterInsert(key)
+	}
+	return inserted
+}
+
+// Sets the entries of data whose key has no value associated with it yet, e.g.
+// to deduplicate on load. Each shard is locked only once. Returns the keys
+// which were inserted, in their normalized form; values rejected by TypeGuard
+// or MaxEntries are not.
+func (m *ConcurrentMapString) MSetIfAbsent(data map[string]interface{}) (inserted []string) {
+	values := make(map[string]interface{}, len(data))
+	keys := make([]string, 0, len(data))
+	for key, value := range data {
+		key = m.normalize(key)
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = value
+	}
+	room := m.room()
+	m.withShardsOf(keys, true, func(shard *concurrentMapSharedString, keys []string) {
+		for _, key := range keys {
+			if _, ok := shard.lookup(key); ok {
+				continue
+			}
+			if isNew, _ := m.store(shard, key, values[key], &room); isNew {
+				inserted = append(inserted, key)
+			}
+		}
+	})
+	for _, key := range inserted {
+		m.afterInsert(key)
+	}
+	return inserted
+}
+
+// Returns the value stored under key, or stores value and returns it if the key
+// is absent. loaded reports whether the value was already present. A value
+// rejected by TypeGuard or MaxEntries yields (nil, false).
+func (m *ConcurrentMapString) getOrSet(key string, value interface{}) (actual interface{}, loaded bool) {
+	key = m.normalize(key)
+	room := m.room()
+	shard := m.lockShard(key)
+	actual, loaded = shard.lookup(key)
+	if !loaded {
+		if _, err := m.store(shard, key, value, &room); err != nil {
+			shard.Unlock()
+			return nil, false
+		}
+		actual = value
 	}
 	shard.Unlock()
-	return !ok
+	if !loaded {
+		m.afterInsert(key)
+	}
+	return m.Uncompress(actual), loaded
+}
+
+// Loads the string stored under key, or stores value if the key is absent.
+// The bool reports whether the value was loaded. An existing value which is
+// not a string is left untouched and "" is returned.
+func (m *ConcurrentMapString) GetOrSetString(key, value string) (string, bool) {
+	actual, loaded := m.getOrSet(key, value)
+	if !loaded {
+		return value, false
+	}
+	s, _ := actual.(string)
+	return s, true
+}
+
+// Loads the int stored under key, or stores value if the key is absent.
+// The bool reports whether the value was loaded. An existing value which is
+// not an int is left untouched and 0 is returned.
+func (m *ConcurrentMapString) GetOrSetInt(key string, value int) (int, bool) {
+	actual, loaded := m.getOrSet(key, value)
+	if !loaded {
+		return value, false
+	}
+	i, _ := actual.(int)
+	return i, true
 }
 
 // Retrieves an element from map under given key.
+// On a miss the Loader option, if set, is asked for the value, see GetOrLoad.
 func (m *ConcurrentMapString) Get(key string) (interface{}, bool) {
+	m.checkNil()
+	var val interface{}
+	var ok bool
+	if m.opts.Loader != nil {
+		val, ok, _ = m.GetOrLoad(key)
+	} else {
+		val, ok = m.get(m.normalize(key))
+	}
+	if m.opts.TrackMetrics {
+		m.ops.countGet(ok)
+	}
+	return val, ok
+}
+
+// Calls fn with the value under key while holding the read lock of its shard,
+// so fields of a shared mutable value can be read without racing with writers
+// which update it under the write lock (e.g. through Upsert). fn MUST NOT
+// retain v, modify it or access the map, and should be short as it blocks the
+// writers of the shard. Expired entries are reported as absent.
+func (m *ConcurrentMapString) View(key string, fn func(v interface{}, exists bool)) {
+	key = m.normalize(key)
+	shard := m.rlockShard(key)
+	defer shard.RUnlock()
+	v, ok := shard.lookup(key)
+	if ok && shard.expired(key, m.now()) {
+		v, ok = nil, false
+	}
+	fn(m.Uncompress(v), ok)
+}
+
+// Returns the value under key and removes it if shouldDelete reports true for
+// it, in one step under the shard write lock. shouldDelete is not called for a
+// missing key and MUST NOT access the map.
+func (m *ConcurrentMapString) GetAndMaybeDelete(key string, shouldDelete func(v interface{}) bool) (value interface{}, deleted bool, exists bool) {
+	key = m.normalize(key)
+	shard := m.lockShard(key)
+	defer shard.Unlock()
+	value, exists = shard.lookup(key)
+	value = m.Uncompress(value)
+	if exists && shouldDelete(value) {
+		shard.remove(key)
+		deleted = true
+	}
+	return value, deleted, exists
+}
+
+// Returns whether each of keys is present, result[i] telling about keys[i].
+// The positions are grouped by shard so that each shard is read locked once,
+// no per key map is built, which keeps huge batches cheap.
+func (m *ConcurrentMapString) HasAllBitset(keys []string) []bool {
+	result := make([]bool, len(keys))
+	normalized := make([]string, len(keys))
+	pending := make([]int, len(keys))
+	for i, key := range keys {
+		normalized[i] = m.normalize(key)
+		pending[i] = i
+	}
+	now := m.now()
+	for len(pending) > 0 {
+		tables, base := m.layout()
+		groups := make([][]int, len(tables))
+		for _, i := range pending {
+			idx := m.locate(normalized[i], tables, base)
+			groups[idx] = append(groups[idx], i)
+		}
+		pending = pending[:0]
+		for idx, group := range groups {
+			if len(group) == 0 {
+				continue
+			}
+			shard := tables[idx]
+			shard.RLock()
+			if shard.retired {
+				pending = append(pending, group...)
+			} else {
+				for _, i := range group {
+					_, ok := shard.lookup(normalized[i])
+					result[i] = ok && !shard.expired(normalized[i], now)
+				}
+			}
+			shard.RUnlock()
+		}
+	}
+	return result
+}
+
+// Splits keys into the present ones, with their values, and the missing ones,
+// e.g. to decide what to fetch when warming a cache. Each involved shard is
+// read locked once. Keys are reported in their normalized form.
+func (m *ConcurrentMapString) Partition(keys []string) (present map[string]interface{}, missing []string) {
+	normalized := make([]string, len(keys))
+	for i, key := range keys {
+		normalized[i] = m.normalize(key)
+	}
+	present = make(map[string]interface{}, len(keys))
+	now := m.now()
+	m.withShardsOf(normalized, false, func(shard *concurrentMapSharedString, keys []string) {
+		for _, key := range keys {
+			if val, ok := shard.lookup(key); ok && !shard.expired(key, now) {
+				present[key] = m.Uncompress(val)
+			} else {
+				missing = append(missing, key)
+			}
+		}
+	})
+	return present, missing
+}
+
+// Retrieves an element from map under given key as clone(value), called under
+// the shard read lock, so the caller owns a copy which no writer updating the
+// stored value under the write lock races with. A nil clone returns the value itself.
+func (m *ConcurrentMapString) GetCopy(key string, clone func(interface{}) interface{}) (interface{}, bool) {
+	var val interface{}
+	var ok bool
+	m.View(key, func(v interface{}, exists bool) {
+		if exists && clone != nil {
+			v = clone(v)
+		}
+		val, ok = v, exists
+	})
+	return val, ok
+}
+
+// Retrieves an element from map under the already normalized key.
+func (m *ConcurrentMapString) get(key string) (interface{}, bool) {
 	// Get shard
-	shard := m.GetShard(key)
-	shard.RLock()
+	shard := m.rlockShard(key)
 	// Get item from shard.
-	val, ok := shard.items[key]
+	val, ok := shard.lookup(key)
+	expired := ok && shard.expired(key, m.now())
+	if ok && !expired && shard.freqs != nil {
+		atomic.AddUint32(shard.freqs[key], 1)
+	}
 	shard.RUnlock()
-	return val, ok
+	if expired {
+		// Lazy expiration, the value may have been refreshed before we got the write lock.
+		shard = m.lockShard(key)
+		val, ok = shard.lookup(key)
+		expired = ok && shard.expired(key, m.now())
+		if expired {
+			shard.remove(key)
+		}
+		shard.Unlock()
+		if expired {
+			m.fireExpire(key, val)
+			val, ok = nil, false
+		}
+	}
+	return m.Uncompress(val), ok
+}
+
+// Retrieves an element like Get, but never blocks: if the read lock of the shard
+// can not be acquired immediately it returns (nil, false, false). The last
+// return value tells whether the lookup actually happened.
+// Expired entries are reported as absent but left for the janitor.
+func (m *ConcurrentMapString) GetNonBlocking(key string) (val interface{}, ok bool, acquired bool) {
+	key = m.normalize(key)
+	shard := m.shardOf(key)
+	if !shard.TryRLock() {
+		return nil, false, false
+	}
+	defer shard.RUnlock()
+	if shard.retired {
+		return nil, false, false
+	}
+	val, ok = shard.lookup(key)
+	if !ok || shard.expired(key, m.now()) {
+		return nil, false, true
+	}
+	if shard.freqs != nil {
+		atomic.AddUint32(shard.freqs[key], 1)
+	}
+	return m.Uncompress(val), true, true
 }
 
-// Returns the number of elements within the map.
+// Returns the number of elements within the map, no shard lock is taken.
 func (m *ConcurrentMapString) Count() int {
-	count := 0
-	for i := 0; i < m.shard_count; i++ {
-		shard := m.tables[i]
+	count := int64(0)
+	for _, shard := range m.shards() {
+		count += atomic.LoadInt64(&shard.count)
+	}
+	return int(count)
+}
+
+// Diagnostics of a map, see Stats.
+type MapStats struct {
+	Count        int
+	ShardCount   int
+	EmptyShards  int
+	MaxShardSize int
+	MinShardSize int
+}
+
+// Returns the diagnostics of the map, gathered in a single pass over the
+// shards, each read locked in turn.
+func (m *ConcurrentMapString) Stats() MapStats {
+	tables := m.shards()
+	stats := MapStats{ShardCount: len(tables)}
+	for i, shard := range tables {
 		shard.RLock()
-		count += len(shard.items)
+		size := shard.size()
 		shard.RUnlock()
+		stats.Count += size
+		if size == 0 {
+			stats.EmptyShards++
+		}
+		if i == 0 || size > stats.MaxShardSize {
+			stats.MaxShardSize = size
+		}
+		if i == 0 || size < stats.MinShardSize {
+			stats.MinShardSize = size
+		}
 	}
-	return count
+	return stats
+}
+
+// Returns the number of elements like Count, summing the shard counters in
+// GOMAXPROCS chunks concurrently. As Count only does one atomic load per
+// shard, this pays off only with many thousands of shards; Count stays serial.
+func (m *ConcurrentMapString) CountParallel() int {
+	tables := m.shards()
+	workers := runtime.GOMAXPROCS(0)
+	chunk := (len(tables) + workers - 1) / workers
+	var count int64
+	wg := sync.WaitGroup{}
+	for start := 0; start < len(tables); start += chunk {
+		end := start + chunk
+		if end > len(tables) {
+			end = len(tables)
+		}
+		wg.Add(1)
+		go func(shards []*concurrentMapSharedString) {
+			sum := int64(0)
+			for _, shard := range shards {
+				sum += atomic.LoadInt64(&shard.count)
+			}
+			atomic.AddInt64(&count, sum)
+			wg.Done()
+		}(tables[start:end])
+	}
+	wg.Wait()
+	return int(count)
+}
+
+// Returns the number of elements as of at most CountRefreshInterval ago. The
+// total is cached and refreshed lazily by the first caller after it went stale,
+// so polling it costs O(1) instead of the O(shards) of Count.
+func (m *ConcurrentMapString) EstimateCount() int {
+	m.checkNil()
+	interval := int64(m.opts.CountRefreshInterval)
+	if interval <= 0 {
+		return m.Count()
+	}
+	now := time.Now().UnixNano()
+	at := atomic.LoadInt64(&m.estAt)
+	if now-at >= interval && atomic.CompareAndSwapInt64(&m.estAt, at, now) {
+		count := m.Count()
+		atomic.StoreInt64(&m.estCount, int64(count))
+		return count
+	}
+	return int(atomic.LoadInt64(&m.estCount))
 }
 
 // Looks up an item under specified key
 func (m *ConcurrentMapString) Has(key string) bool {
+	key = m.normalize(key)
 	// Get shard
-	shard := m.GetShard(key)
-	shard.RLock()
+	shard := m.rlockShard(key)
 	// See if element is within shard.
-	_, ok := shard.items[key]
+	_, ok := shard.lookup(key)
+	ok = ok && !shard.expired(key, m.now())
 	shard.RUnlock()
 	return ok
 }
 
 // Removes an element from the map.
 func (m *ConcurrentMapString) Remove(key string) {
+	key = m.normalize(key)
 	// Try to get shard.
-	shard := m.GetShard(key)
-	shard.Lock()
-	delete(shard.items, key)
+	shard := m.lockShard(key)
+	shard.remove(key)
 	shard.Unlock()
 }
 
 // Removes an element from the map and returns it
 func (m *ConcurrentMapString) Pop(key string) (v interface{}, exists bool) {
+	key = m.normalize(key)
 	// Try to get shard.
-	shard := m.GetShard(key)
-	shard.Lock()
-	v, exists = shard.items[key]
-	delete(shard.items, key)
+	shard := m.lockShard(key)
+	v, exists = shard.remove(key)
 	shard.Unlock()
-	return v, exists
+	return m.Uncompress(v), exists
+}
+
+// Retrieves the values under the given keys, keys which are not in the map are
+// absent from the result. Each shard is read locked once, in ascending index
+// order like every multi-shard operation, so it can be freely combined with
+// LockKeys and the other batch methods.
+func (m *ConcurrentMapString) MGet(keys []string) map[string]interface{} {
+	normalized := make([]string, len(keys))
+	for i, key := range keys {
+		normalized[i] = m.normalize(key)
+	}
+	found := make(map[string]interface{}, len(keys))
+	now := m.now()
+	m.withShardsOf(normalized, false, func(shard *concurrentMapSharedString, keys []string) {
+		for _, key := range keys {
+			if v, ok := shard.lookup(key); ok && !shard.expired(key, now) {
+				found[key] = m.Uncompress(v)
+			}
+		}
+	})
+	return found
+}
+
+// Removes the given keys, locking each shard once in ascending index order.
+func (m *ConcurrentMapString) MRemove(keys []string) {
+	normalized := make([]string, len(keys))
+	for i, key := range keys {
+		normalized[i] = m.normalize(key)
+	}
+	m.withShardsOf(normalized, true, func(shard *concurrentMapSharedString, keys []string) {
+		for _, key := range keys {
+			shard.remove(key)
+		}
+	})
+}
+
+// Removes the given keys and returns the removed entries, keys which are not in
+// the map are absent from the result. Each shard is locked only once.
+func (m *ConcurrentMapString) MPop(keys []string) map[string]interface{} {
+	normalized := make([]string, len(keys))
+	for i, key := range keys {
+		normalized[i] = m.normalize(key)
+	}
+	popped := make(map[string]interface{})
+	m.withShardsOf(normalized, true, func(shard *concurrentMapSharedString, keys []string) {
+		for _, key := range keys {
+			if v, ok := shard.remove(key); ok {
+				popped[key] = m.Uncompress(v)
+			}
+		}
+	})
+	return popped
 }
 
 // Checks if map is empty.
@@ -161,20 +1600,61 @@ type TupleString struct {
 // Deprecated: using IterBuffered() will get a better performence
 func (m *ConcurrentMapString) Iter() <-chan TupleString {
 	chans := snapshot(m)
-	ch := make(chan TupleString)
-	go fanIn(chans, ch)
+	ch := make(chan TupleString)
+	go fanIn(m, chans, ch)
+	return ch
+}
+
+// Returns a buffered iterator which could be used in a for range loop.
+func (m *ConcurrentMapString) IterBuffered() <-chan TupleString {
+	if m.iterSerially() {
+		var tuples []TupleString
+		for _, shard := range m.shards() {
+			shard.RLock()
+			m.eachPlain(shard, func(key string, val interface{}) bool {
+				tuples = append(tuples, TupleString{key, val})
+				return true
+			})
+			shard.RUnlock()
+		}
+		ch := make(chan TupleString, len(tuples))
+		for _, t := range tuples {
+			ch <- t
+		}
+		close(ch)
+		return ch
+	}
+	chans := snapshot(m)
+	total := 0
+	for _, c := range chans {
+		total += cap(c)
+	}
+	ch := make(chan TupleString, total)
+	if m.opts.Ordered {
+		go concat(chans, ch)
+	} else {
+		go fanIn(m, chans, ch)
+	}
 	return ch
 }
 
-// Returns a buffered iterator which could be used in a for range loop.
-func (m *ConcurrentMapString) IterBuffered() <-chan TupleString {
+// Reports whether a map this small is walked shard by shard in the calling
+// goroutine, which beats spawning a goroutine per shard below SerialIterThreshold.
+func (m *ConcurrentMapString) iterSerially() bool {
+	return m.Count() < m.opts.SerialIterThreshold
+}
+
+// Returns a buffered iterator which takes one element from each shard in turn,
+// so that a prefix of the output is spread evenly across the shards.
+// Useful for sampling/debugging when only the first few elements are consumed.
+func (m *ConcurrentMapString) IterRoundRobin() <-chan TupleString {
 	chans := snapshot(m)
 	total := 0
 	for _, c := range chans {
 		total += cap(c)
 	}
 	ch := make(chan TupleString, total)
-	go fanIn(chans, ch)
+	go roundRobin(chans, ch)
 	return ch
 }
 
@@ -183,19 +1663,23 @@ func (m *ConcurrentMapString) IterBuffered() <-chan TupleString {
 // It returns once the size of each buffered channel is determined,
 // before all the channels are populated using goroutines.
 func snapshot(m *ConcurrentMapString) (chans []chan TupleString) {
-	chans = make([]chan TupleString, m.shard_count)
+	tables := m.shards()
+	chans = make([]chan TupleString, len(tables))
 	wg := sync.WaitGroup{}
-	wg.Add(m.shard_count)
+	wg.Add(len(tables))
 	// Foreach shard.
-	for index, shard := range m.tables {
+	for index, shard := range tables {
+		m.acquireIter()
 		go func(index int, shard *concurrentMapSharedString) { //注意：在子协程中使用for range生成的变量时一定作为参数传给子协程
+			defer m.releaseIter()
 			// Foreach key, value pair.
 			shard.RLock()
-			chans[index] = make(chan TupleString, len(shard.items))
+			chans[index] = make(chan TupleString, shard.size())
 			wg.Done()
-			for key, val := range shard.items {
+			m.eachPlain(shard, func(key string, val interface{}) bool {
 				chans[index] <- TupleString{key, val}
-			}
+				return true
+			})
 			shard.RUnlock()
 			close(chans[index])
 		}(index, shard)
@@ -205,7 +1689,12 @@ func snapshot(m *ConcurrentMapString) (chans []chan TupleString) {
 }
 
 // fanInuint32 reads elements from channels `chans` into channel `out`
-func fanIn(chans []chan TupleString, out chan TupleString) {
+func fanIn(m *ConcurrentMapString, chans []chan TupleString, out chan TupleString) {
+	if m.iterSlots != nil {
+		//the goroutines below would block on a slow reader of out, holding their slots
+		concat(chans, out)
+		return
+	}
 	wg := sync.WaitGroup{}
 	wg.Add(len(chans))
 	for _, ch := range chans {
@@ -220,6 +1709,142 @@ func fanIn(chans []chan TupleString, out chan TupleString) {
 	close(out)
 }
 
+// Takes a slot for a per shard iteration goroutine in the MaxIterGoroutines
+// mode, blocking until one is free. The goroutine MUST NOT block on the reader
+// of the iteration, which might be waiting for a slot itself.
+func (m *ConcurrentMapString) acquireIter() {
+	if m.iterSlots != nil {
+		m.iterSlots <- struct{}{}
+	}
+}
+
+func (m *ConcurrentMapString) releaseIter() {
+	if m.iterSlots != nil {
+		<-m.iterSlots
+	}
+}
+
+// concat reads all elements of `chans` one channel after another into channel `out`
+func concat(chans []chan TupleString, out chan TupleString) {
+	for _, ch := range chans {
+		for t := range ch {
+			out <- t
+		}
+	}
+	close(out)
+}
+
+// roundRobin reads one element from each of `chans` in turn into channel `out`,
+// until all of them are drained.
+func roundRobin(chans []chan TupleString, out chan TupleString) {
+	//compacting chans in place would overwrite the entries the snapshot goroutines still send to
+	live := append([]chan TupleString(nil), chans...)
+	for len(live) > 0 {
+		next := live[:0]
+		for _, ch := range live {
+			if t, ok := <-ch; ok {
+				out <- t
+				next = append(next, ch)
+			}
+		}
+		live = next
+	}
+	close(out)
+}
+
+// Returns the number of shards the map is divided into.
+func (m *ConcurrentMapString) ShardCount() int {
+	return len(m.shards())
+}
+
+// Returns a copy of the items in the shard with the given index.
+// Together with ShardCount it lets callers statically partition work per shard.
+func (m *ConcurrentMapString) ShardItems(shardIndex int) (map[string]interface{}, error) {
+	tables := m.shards()
+	if shardIndex < 0 || shardIndex >= len(tables) {
+		return nil, fmt.Errorf("shard index %d out of range [0, %d)", shardIndex, len(tables))
+	}
+	shard := tables[shardIndex]
+	shard.RLock()
+	tmp := make(map[string]interface{}, shard.size())
+	shard.rangeItems(func(key string, val interface{}) bool {
+		tmp[key] = m.Uncompress(val)
+		return true
+	})
+	shard.RUnlock()
+	return tmp, nil
+}
+
+// Calls fn for every entry of the shard with the given index while holding its
+// read lock, e.g. to inspect a hot shard without copying it like ShardItems.
+// fn must not access the map, since the shard stays locked.
+func (m *ConcurrentMapString) IterShardCb(shardIndex int, fn IterCb) error {
+	tables := m.shards()
+	if shardIndex < 0 || shardIndex >= len(tables) {
+		return fmt.Errorf("shard index %d out of range [0, %d)", shardIndex, len(tables))
+	}
+	shard := tables[shardIndex]
+	shard.RLock()
+	m.eachPlain(shard, func(key string, val interface{}) bool {
+		fn(key, val)
+		return true
+	})
+	shard.RUnlock()
+	return nil
+}
+
+// Swaps the items of the shard with the given index for an empty map and returns
+// the old ones, e.g. to process metrics double-buffered shard by shard.
+// Writes after the swap go to the new map. Returns nil if the index is out of range.
+func (m *ConcurrentMapString) SwapShardContents(shardIndex int) map[string]interface{} {
+	tables := m.shards()
+	if shardIndex < 0 || shardIndex >= len(tables) {
+		return nil
+	}
+	shard := tables[shardIndex]
+	shard.Lock()
+	old := shard.replace(make(map[string]interface{}))
+	shard.Unlock()
+	if m.opts.CompressThreshold > 0 {
+		for key, val := range old {
+			old[key] = m.Uncompress(val)
+		}
+	}
+	return old
+}
+
+// Atomically replaces the contents of the shard at shardIndex with items,
+// which the map takes ownership of, e.g. to reload a partition at once. The
+// keys MUST be normalized and belong to the shard (GetShardIndex), otherwise
+// an error is returned and nothing is changed; as for a bad index.
+func (m *ConcurrentMapString) ReplaceShard(shardIndex int, items map[string]interface{}) error {
+	for {
+		tables, base := m.layout()
+		if shardIndex < 0 || shardIndex >= len(tables) {
+			return fmt.Errorf("shard index %d out of range [0, %d)", shardIndex, len(tables))
+		}
+		for key := range items {
+			if idx := m.locate(key, tables, base); idx != shardIndex {
+				return fmt.Errorf("key %s belongs to shard %d, not %d", key, idx, shardIndex)
+			}
+		}
+		if m.opts.CompressThreshold > 0 {
+			for key, val := range items {
+				items[key] = m.compress(val)
+			}
+		}
+		shard := tables[shardIndex]
+		shard.Lock()
+		if !shard.retired {
+			shard.replace(items)
+			shard.Unlock()
+			return nil
+		}
+		//swapped out meanwhile, the placement may have changed
+		shard.Unlock()
+	}
+}
+
 // Returns all items as map[string]interface{}
 func (m *ConcurrentMapString) Items() map[string]interface{} {
 	tmp := make(map[string]interface{})
@@ -232,6 +1857,91 @@ func (m *ConcurrentMapString) Items() map[string]interface{} {
 	return tmp
 }
 
+// Calls fn with the items of the shard owning key while holding its write lock,
+// so several keys of the same shard can be read and updated atomically. fn MAY
+// add and remove entries, the bookkeeping (Count, TTLs, the modes' side data)
+// is brought up to date afterwards, but no hooks, eviction or resize run. Keys
+// added MUST be normalized and belong to the shard. items holds the values as
+// stored, i.e. *CompressedValue in the CompressThreshold mode (see Uncompress).
+// fn MUST NOT access the map, the locks are not reentrant.
+func (m *ConcurrentMapString) WithShard(key string, fn func(items map[string]interface{})) {
+	m.WithShardResult(key, func(items map[string]interface{}) interface{} {
+		fn(items)
+		return nil
+	})
+}
+
+// Like WithShard, returning the result of fn after the lock is released.
+func (m *ConcurrentMapString) WithShardResult(key string, fn func(items map[string]interface{}) interface{}) interface{} {
+	key = m.normalize(key)
+	shard := m.lockShard(key)
+	defer shard.Unlock()
+	defer shard.resync()
+	if atomic.LoadInt32(&m.indexes.n) > 0 {
+		//fn may change anything, reindex the shard as a whole
+		shard.indexes.dropAll(shard)
+		defer func() {
+			shard.indexes.addAll(shard)
+		}()
+	}
+	if !m.opts.DebugLeaks {
+		defer shard.fit()
+		return fn(shard.itemsMap())
+	}
+	if shard.leaked() {
+		//the deferred Unlock releases the shard
+		panic(leakPanic)
+	}
+	lent := make(map[string]interface{}, shard.size())
+	shard.rangeItems(func(k string, v interface{}) bool {
+		lent[k] = v
+		return true
+	})
+	defer shard.takeBack(lent)
+	return fn(lent)
+}
+
+// Returns a copy of all items taken at a single instant: the read locks of all
+// shards are acquired in index order and held together while copying, so an
+// update spanning several shards (CompareAndSwapMany) is seen either entirely
+// or not at all. Unlike Items it briefly blocks all writers of the map.
+func (m *ConcurrentMapString) SnapshotConsistent() map[string]interface{} {
+	for {
+		tables := m.shards()
+		retired := false
+		locked := 0
+		var tmp map[string]interface{}
+		for _, shard := range tables {
+			shard.RLock()
+			locked++
+			if shard.retired {
+				retired = true
+				break
+			}
+		}
+		if !retired {
+			//not m.Count(), it takes m.lock which Resize holds while waiting for our shards
+			size := 0
+			for _, shard := range tables {
+				size += shard.size()
+			}
+			tmp = make(map[string]interface{}, size)
+			for _, shard := range tables {
+				shard.rangeItems(func(key string, val interface{}) bool {
+					tmp[key] = m.Uncompress(val)
+					return true
+				})
+			}
+		}
+		for _, shard := range tables[:locked] {
+			shard.RUnlock()
+		}
+		if !retired {
+			return tmp
+		}
+	}
+}
+
 // Iterator callback,called for every key,value found in
 // maps. RLock is held for all calls for a given shard
 // therefore callback sess consistent view of a shard,
@@ -241,31 +1951,405 @@ type IterCb func(key string, v interface{})
 // Callback based iterator, cheapest way to read
 // all elements in a map.
 func (m *ConcurrentMapString) IterCb(fn IterCb) {
-	for idx := range m.tables {
-		shard := (m.tables)[idx]
+	tables := m.shards()
+	for idx := range tables {
+		shard := tables[idx]
 		shard.RLock()
-		for key, value := range shard.items {
+		if m.opts.DebugLeaks && shard.leaked() {
+			shard.RUnlock()
+			panic(leakPanic)
+		}
+		m.eachPlain(shard, func(key string, value interface{}) bool {
 			fn(key, value)
+			return true
+		})
+		shard.RUnlock()
+	}
+}
+
+// Calls fn sequentially for each key and value, mirroring sync.Map.Range.
+// Stops the iteration as soon as fn returns false.
+// RLock of a shard is held while fn is called for its entries.
+func (m *ConcurrentMapString) Range(fn func(key string, value interface{}) bool) {
+	for _, shard := range m.shards() {
+		more := true
+		shard.RLock()
+		m.eachPlain(shard, func(key string, value interface{}) bool {
+			more = fn(key, value)
+			return more
+		})
+		shard.RUnlock()
+		if !more {
+			return
+		}
+	}
+}
+
+// Returns min(n, Count()) entries picked uniformly at random by reservoir
+// sampling, without materializing the whole map.
+func (m *ConcurrentMapString) Sample(n int) []TupleString {
+	if n <= 0 {
+		return nil
+	}
+	sample := make([]TupleString, 0, n)
+	seen := 0
+	for _, shard := range m.shards() {
+		shard.RLock()
+		shard.rangeItems(func(key string, value interface{}) bool {
+			seen++
+			if len(sample) < n {
+				sample = append(sample, TupleString{key, value})
+			} else if i := rand.Intn(seen); i < n {
+				sample[i] = TupleString{key, value}
+			}
+			return true
+		})
+		shard.RUnlock()
+	}
+	for i := range sample {
+		sample[i].Val = m.Uncompress(sample[i].Val)
+	}
+	return sample
+}
+
+// Returns a key chosen with probability proportional to weight of its value,
+// in a single pass under the shard read locks: each entry replaces the choice
+// so far with probability weight/(sum of the weights seen). Entries with a
+// weight <= 0 are never chosen, ok is false if no entry has a positive weight.
+func (m *ConcurrentMapString) WeightedSample(weight func(v interface{}) float64) (key string, ok bool) {
+	total := 0.0
+	m.IterCb(func(k string, v interface{}) {
+		w := weight(v)
+		if w <= 0 {
+			return
+		}
+		total += w
+		if rand.Float64()*total < w {
+			key, ok = k, true
+		}
+	})
+	return key, ok
+}
+
+// Returns conv applied to every entry, e.g. to build the repeated field of a
+// protobuf message. conv is called under the shard read locks and MUST NOT
+// access the map. The order of the results is the iteration order of IterCb.
+func (m *ConcurrentMapString) ToStructs(conv func(key string, v interface{}) interface{}) []interface{} {
+	res := make([]interface{}, 0, m.Count())
+	m.IterCb(func(key string, v interface{}) {
+		res = append(res, conv(key, v))
+	})
+	return res
+}
+
+// Compares m with an older snapshot: added keys are only in m, removed ones
+// only in old, changed ones are in both with values eq reports different (nil
+// eq uses reflect.DeepEqual). Both maps are copied shard by shard under their
+// read locks first, the keys are returned sorted.
+func (m *ConcurrentMapString) Diff(old *ConcurrentMapString, eq func(a, b interface{}) bool) (added, removed []string, changed []string) {
+	if eq == nil {
+		eq = reflect.DeepEqual
+	}
+	before, after := old.Items(), m.Items()
+	for key, val := range after {
+		if oldVal, ok := before[key]; !ok {
+			added = append(added, key)
+		} else if !eq(oldVal, val) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+// Makes the map match desired: its keys are inserted or updated (when the value
+// differs according to reflect.DeepEqual) and all the other keys are removed.
+// It works shard by shard, each shard is locked once and the others keep
+// serving meanwhile, so readers may see a mix of the old and new states until
+// it returns. Returns the changed keys, each list sorted.
+func (m *ConcurrentMapString) Reconcile(desired map[string]interface{}) (added, updated, removed []string) {
+	want := make(map[string]interface{}, len(desired))
+	for key, value := range desired {
+		want[m.normalize(key)] = value
+	}
+	for {
+		tables, base := m.layout()
+		groups := make([]map[string]interface{}, len(tables))
+		for key, value := range want {
+			idx := m.locate(key, tables, base)
+			if groups[idx] == nil {
+				groups[idx] = make(map[string]interface{})
+			}
+			groups[idx][key] = value
+		}
+		retired := false
+		room := m.room()
+		for idx, shard := range tables {
+			var inserted []string
+			shard.Lock()
+			if shard.retired {
+				//resized meanwhile, the shards done so far already match and report no changes on the retry
+				shard.Unlock()
+				retired = true
+				break
+			}
+			now := m.now()
+			shard.rangeItems(func(key string, _ interface{}) bool {
+				if _, ok := groups[idx][key]; !ok {
+					shard.remove(key)
+					removed = append(removed, key)
+				}
+				return true
+			})
+			for key, value := range groups[idx] {
+				old, ok := shard.lookup(key)
+				live := ok && !shard.expired(key, now)
+				if live && reflect.DeepEqual(m.Uncompress(old), value) {
+					continue
+				}
+				value = m.compress(value)
+				if _, err := m.store(shard, key, value, &room); err != nil {
+					continue
+				}
+				if live {
+					updated = append(updated, key)
+				} else {
+					added = append(added, key)
+				}
+				if !ok {
+					inserted = append(inserted, key)
+				}
+			}
+			shard.Unlock()
+			for _, key := range inserted {
+				m.afterInsert(key)
+			}
+		}
+		if !retired {
+			break
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(updated)
+	sort.Strings(removed)
+	return added, updated, removed
+}
+
+// Returns how many entries hold values of each type, keyed by
+// reflect.TypeOf(v).String() and "nil" for nil values. Helps to spot values of
+// unexpected types in a heterogeneous map.
+func (m *ConcurrentMapString) TypeHistogram() map[string]int {
+	histogram := make(map[string]int)
+	m.IterCb(func(key string, v interface{}) {
+		if v == nil {
+			histogram["nil"]++
+		} else {
+			histogram[reflect.TypeOf(v).String()]++
+		}
+	})
+	return histogram
+}
+
+// Returns the entry with the largest value according to less, scanning the
+// shards under their read locks. ok is false if the map is empty.
+func (m *ConcurrentMapString) MaxBy(less func(a, b interface{}) bool) (key string, value interface{}, ok bool) {
+	m.IterCb(func(k string, v interface{}) {
+		if !ok || less(value, v) {
+			key, value, ok = k, v, true
+		}
+	})
+	return key, value, ok
+}
+
+// Returns the entry with the smallest value according to less, see MaxBy.
+func (m *ConcurrentMapString) MinBy(less func(a, b interface{}) bool) (key string, value interface{}, ok bool) {
+	return m.MaxBy(func(a, b interface{}) bool {
+		return less(b, a)
+	})
+}
+
+// Returns the n entries with the largest values according to less, sorted
+// descending. Only a min-heap of n entries is kept while scanning, so it costs
+// O(Count()·log n) time and O(n) memory instead of a full sort.
+func (m *ConcurrentMapString) TopN(n int, less func(a, b interface{}) bool) []TupleString {
+	if n <= 0 {
+		return nil
+	}
+	h := &tupleHeap{less: less}
+	m.IterCb(func(key string, v interface{}) {
+		if len(h.tuples) < n {
+			heap.Push(h, TupleString{key, v})
+		} else if less(h.tuples[0].Val, v) {
+			h.tuples[0] = TupleString{key, v}
+			heap.Fix(h, 0)
 		}
+	})
+	top := make([]TupleString, len(h.tuples))
+	for i := len(top) - 1; i >= 0; i-- {
+		top[i] = heap.Pop(h).(TupleString)
+	}
+	return top
+}
+
+// Min-heap of tuples ordered by less on their values, used by TopN.
+type tupleHeap struct {
+	tuples []TupleString
+	less   func(a, b interface{}) bool
+}
+
+func (h *tupleHeap) Len() int           { return len(h.tuples) }
+func (h *tupleHeap) Less(i, j int) bool { return h.less(h.tuples[i].Val, h.tuples[j].Val) }
+func (h *tupleHeap) Swap(i, j int)      { h.tuples[i], h.tuples[j] = h.tuples[j], h.tuples[i] }
+func (h *tupleHeap) Push(x interface{}) { h.tuples = append(h.tuples, x.(TupleString)) }
+func (h *tupleHeap) Pop() interface{} {
+	last := h.tuples[len(h.tuples)-1]
+	h.tuples = h.tuples[:len(h.tuples)-1]
+	return last
+}
+
+// Replaces every value with the result of fn, shard by shard under the write
+// lock. fn MUST NOT access the map. TTLs are kept, results rejected by
+// TypeGuard leave the old value in place and nil results remove the key with
+// RejectNil. ReplaceAll and Resize wait until it is done, so every entry is
+// transformed exactly once.
+func (m *ConcurrentMapString) MapValues(fn func(key string, v interface{}) interface{}) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, shard := range m.tables {
+		shard.Lock()
+		shard.rangeItems(func(key string, v interface{}) bool {
+			v = fn(key, m.Uncompress(v))
+			deadline, ttl := shard.expires[key]
+			if _, err := m.store(shard, key, v, nil); err != nil {
+				return true
+			}
+			if ttl && !m.rejectsNil(v) {
+				shard.expires[key] = deadline
+			}
+			return true
+		})
+		shard.Unlock()
+	}
+}
+
+// Removes all the keys starting with prefix and returns how many were removed.
+// prefix is matched against the stored, i.e. normalized, keys. As keys are
+// spread by hash, every shard is write locked in turn.
+func (m *ConcurrentMapString) RemovePrefix(prefix string) int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	removed := 0
+	for _, shard := range m.tables {
+		shard.Lock()
+		shard.rangeItems(func(key string, _ interface{}) bool {
+			if strings.HasPrefix(key, prefix) {
+				shard.remove(key)
+				removed++
+			}
+			return true
+		})
+		shard.Unlock()
+	}
+	return removed
+}
+
+// Like MapValues, but the entries for which fn returns keep == false are
+// deleted instead, mapping and filtering in a single locked pass. fn MUST NOT
+// access the map, the locks are not reentrant.
+func (m *ConcurrentMapString) TransformOrDelete(fn func(key string, v interface{}) (interface{}, bool)) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, shard := range m.tables {
+		shard.Lock()
+		shard.rangeItems(func(key string, v interface{}) bool {
+			v, keep := fn(key, m.Uncompress(v))
+			if !keep {
+				shard.remove(key)
+				return true
+			}
+			deadline, ttl := shard.expires[key]
+			if _, err := m.store(shard, key, v, nil); err != nil {
+				return true
+			}
+			if ttl && !m.rejectsNil(v) {
+				shard.expires[key] = deadline
+			}
+			return true
+		})
+		shard.Unlock()
+	}
+}
+
+// Parallel callback based iterator, fn is called by a pool of `workers` goroutines.
+// The read lock of a shard is held only while its entries are collected, not while
+// fn runs, so fn MUST be safe for concurrent invocation and may see stale entries.
+func (m *ConcurrentMapString) IterCbParallel(workers int, fn IterCb) {
+	if workers <= 0 {
+		workers = 1
+	}
+	ch := make(chan TupleString, workers)
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for t := range ch {
+				fn(t.Key, m.Uncompress(t.Val))
+			}
+			wg.Done()
+		}()
+	}
+	for _, shard := range m.shards() {
+		shard.RLock()
+		tuples := make([]TupleString, 0, shard.size())
+		shard.rangeItems(func(key string, value interface{}) bool {
+			tuples = append(tuples, TupleString{key, value})
+			return true
+		})
 		shard.RUnlock()
+		for _, t := range tuples {
+			ch <- t
+		}
 	}
+	close(ch)
+	wg.Wait()
 }
 
 // Return all keys as []string
+// In the Ordered mode keys are in insertion order within a shard and shards in index order.
 func (m *ConcurrentMapString) Keys() []string {
+	m.checkNil()
+	if m.opts.Ordered || m.iterSerially() {
+		keys := make([]string, 0, m.Count())
+		m.KeysCb(func(key string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		return keys
+	}
 	count := m.Count()
 	ch := make(chan string, count)
 	go func() {
 		// 遍历所有的 shard.
 		wg := sync.WaitGroup{}
-		wg.Add(m.shard_count)
-		for _, shard := range m.tables {
+		tables := m.shards()
+		wg.Add(len(tables))
+		for _, shard := range tables {
+			m.acquireIter()
 			go func(shard *concurrentMapSharedString) { //注意：在子协程中使用for range生成的变量时一定作为参数传给子协程
+				defer m.releaseIter()
 				// 遍历所有的 key, value 键值对.
 				shard.RLock()
-				for key := range shard.items {
+				shard.rangeItems(func(key string, _ interface{}) bool {
 					ch <- key
-				}
+					return true
+				})
 				shard.RUnlock()
 				wg.Done()
 			}(shard)
@@ -282,7 +2366,25 @@ func (m *ConcurrentMapString) Keys() []string {
 	return keys
 }
 
-//Reviles ConcurrentMapString "private" variables to json marshal.
+// Calls fn with every key without building the whole key slice like Keys does.
+// Stops as soon as fn returns false. RLock of a shard is held while fn is called for its keys.
+func (m *ConcurrentMapString) KeysCb(fn func(key string) bool) {
+	for _, shard := range m.shards() {
+		more := true
+		shard.RLock()
+		//each, not eachPlain: the values are not needed, so compressed ones stay so
+		shard.each(func(key string, _ interface{}) bool {
+			more = fn(key)
+			return more
+		})
+		shard.RUnlock()
+		if !more {
+			return
+		}
+	}
+}
+
+// Reviles ConcurrentMapString "private" variables to json marshal.
 func (m *ConcurrentMapString) MarshalJSON() ([]byte, error) {
 	// Create a temporary map, which will hold all item spread across shards.
 	tmp := make(map[string]interface{})
@@ -294,6 +2396,70 @@ func (m *ConcurrentMapString) MarshalJSON() ([]byte, error) {
 	return json.Marshal(tmp)
 }
 
+// Marshals only the entries under keys into a JSON object, absent and expired
+// keys are left out. Each involved shard is read locked once for all its keys.
+func (m *ConcurrentMapString) MarshalJSONSubset(keys []string) ([]byte, error) {
+	normalized := make([]string, len(keys))
+	for i, key := range keys {
+		normalized[i] = m.normalize(key)
+	}
+	tmp := make(map[string]interface{}, len(keys))
+	now := m.now()
+	m.withShardsOf(normalized, false, func(shard *concurrentMapSharedString, keys []string) {
+		for _, key := range keys {
+			if val, ok := shard.lookup(key); ok && !shard.expired(key, now) {
+				tmp[key] = m.Uncompress(val)
+			}
+		}
+	})
+	return json.Marshal(tmp)
+}
+
+// Marshals up to limit entries starting at offset, in key order, as
+// {"total":<Count>,"items":[{"key":...,"value":...},...]}. Every call sorts a
+// snapshot of all the keys, so paging is stable but meant for moderate maps.
+func (m *ConcurrentMapString) MarshalPage(offset, limit int) ([]byte, error) {
+	type entry struct {
+		Key   string      `json:"key"`
+		Value interface{} `json:"value"`
+	}
+	items := m.Items()
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(keys) {
+		offset = len(keys)
+	}
+	if limit < 0 || offset+limit > len(keys) {
+		limit = len(keys) - offset
+	}
+	page := struct {
+		Total int     `json:"total"`
+		Items []entry `json:"items"`
+	}{Total: len(keys), Items: make([]entry, 0, limit)}
+	for _, key := range keys[offset : offset+limit] {
+		page.Items = append(page.Items, entry{key, items[key]})
+	}
+	return json.Marshal(page)
+}
+
+// Hasher whose output is part of the public contract and will never change
+// across versions, unlike the default hasher: 32-bit FNV-1 over the bytes of key.
+func DeterministicHasher(key string) uint32 {
+	hash := uint32(2166136261)
+	const prime32 = uint32(16777619)
+	for i := 0; i < len(key); i++ {
+		hash *= prime32
+		hash ^= uint32(key[i])
+	}
+	return hash
+}
+
 func fnv32(key string) uint32 {
 	hash := uint32(2166136261)
 	const prime32 = uint32(16777619)
@@ -304,6 +2470,22 @@ func fnv32(key string) uint32 {
 	return hash
 }
 
+// fnv32 of the bytes of seed followed by key. Different seeds give unrelated
+// placements, so keys crafted to collide under one seed are spread under others.
+func fnv32Seed(seed uint32, key string) uint32 {
+	hash := uint32(2166136261)
+	const prime32 = uint32(16777619)
+	for i := uint(0); i < 32; i += 8 {
+		hash *= prime32
+		hash ^= (seed >> i) & 0xff
+	}
+	for i := 0; i < len(key); i++ {
+		hash *= prime32
+		hash ^= uint32(key[i])
+	}
+	return hash
+}
+
 // Concurrent map uses Interface{} as its value, therefor JSON Unmarshal
 // will probably won't know which to type to unmarshal into, in such case
 // we'll end up with a value of type map[string]interface{}, In most cases this isn't
@@ -334,7 +2516,12 @@ type MyMap struct {
 var myMap *MyMap
 
 func init() {
-	myMap = &MyMap{
+	myMap = NewMyMap()
+}
+
+// Creates a map guarded by a single mutex.
+func NewMyMap() *MyMap {
+	return &MyMap{
 		m: make(map[string]interface{}, 100),
 	}
 }
@@ -364,3 +2551,48 @@ func (myMap *MyMap) BuiltinMapDelete(k string) {
 		delete(myMap.m, k)
 	}
 }
+
+func (myMap *MyMap) Set(k string, v interface{}) {
+	myMap.BuiltinMapStore(k, v)
+}
+
+func (myMap *MyMap) Get(k string) (interface{}, bool) {
+	myMap.Lock()
+	defer myMap.Unlock()
+	v, ok := myMap.m[k]
+	return v, ok
+}
+
+func (myMap *MyMap) Has(k string) bool {
+	_, ok := myMap.Get(k)
+	return ok
+}
+
+func (myMap *MyMap) Remove(k string) {
+	myMap.BuiltinMapDelete(k)
+}
+
+func (myMap *MyMap) Count() int {
+	myMap.Lock()
+	defer myMap.Unlock()
+	return len(myMap.m)
+}
+
+func (myMap *MyMap) Keys() []string {
+	myMap.Lock()
+	defer myMap.Unlock()
+	keys := make([]string, 0, len(myMap.m))
+	for k := range myMap.m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// The lock is held for all calls of fn.
+func (myMap *MyMap) IterCb(fn IterCb) {
+	myMap.Lock()
+	defer myMap.Unlock()
+	for k, v := range myMap.m {
+		fn(k, v)
+	}
+}
@@ -0,0 +1,1619 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRejectNil(t *testing.T) {
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, RejectNil: true})
+	m.Set("a", nil)
+	if m.Has("a") {
+		t.Fatal("Set(a, nil) stored the key")
+	}
+	m.Set("a", 1)
+	m.Set("a", nil)
+	if m.Has("a") {
+		t.Fatal("Set(a, nil) did not remove the key")
+	}
+
+	m.MSet(map[string]interface{}{"a": 1, "b": 2})
+	if !m.CompareAndSwapMany([]CasTuple{{Key: "a", Old: 1, New: nil}, {Key: "b", Old: 2, New: 3}}) {
+		t.Fatal("CompareAndSwapMany failed")
+	}
+	checkContents(t, m, map[string]interface{}{"b": 3})
+
+	m.MSet(map[string]interface{}{"a": 1, "c": 3})
+	m.MapValues(func(key string, v interface{}) interface{} {
+		if key == "a" {
+			return nil
+		}
+		return v
+	})
+	checkContents(t, m, map[string]interface{}{"b": 3, "c": 3})
+
+	m.TransformOrDelete(func(key string, v interface{}) (interface{}, bool) {
+		if key == "b" {
+			return nil, true
+		}
+		return v, true
+	})
+	checkContents(t, m, map[string]interface{}{"c": 3})
+
+	m.ReplaceAll(map[string]interface{}{"x": nil, "y": 1})
+	checkContents(t, m, map[string]interface{}{"y": 1})
+
+	src := NewConcurrentMapString(4)
+	src.Set("y", nil)
+	if !Move(src, m, "y", nil) {
+		t.Fatal("Move failed")
+	}
+	if src.Has("y") || m.Has("y") {
+		t.Fatal("Move stored a nil value")
+	}
+}
+
+func TestCompareAndSwapManyAllOrNothing(t *testing.T) {
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, TypeGuard: true})
+	m.MSet(map[string]interface{}{"a": 1, "b": 2, "c": 3})
+	want := map[string]interface{}{"a": 1, "b": 2, "c": 3}
+
+	//a stale old value aborts the whole batch
+	if m.CompareAndSwapMany([]CasTuple{{Key: "a", Old: 1, New: 10}, {Key: "b", Old: 99, New: 20}}) {
+		t.Fatal("CompareAndSwapMany succeeded with a stale value")
+	}
+	checkContents(t, m, want)
+	if m.CompareAndSwapMany([]CasTuple{{Key: "a", Old: 1, New: 10}, {Key: "missing", Old: nil, New: 20}}) {
+		t.Fatal("CompareAndSwapMany succeeded with a missing key")
+	}
+	checkContents(t, m, want)
+
+	//so does a value rejected by TypeGuard
+	if m.CompareAndSwapMany([]CasTuple{{Key: "a", Old: 1, New: 10}, {Key: "c", Old: 3, New: "x"}}) {
+		t.Fatal("CompareAndSwapMany succeeded with a value of the wrong type")
+	}
+	checkContents(t, m, want)
+
+	if !m.CompareAndSwapMany([]CasTuple{{Key: "a", Old: 1, New: 10}, {Key: "b", Old: 2, New: 20}, {Key: "c", Old: 3, New: 30}}) {
+		t.Fatal("CompareAndSwapMany failed")
+	}
+	checkContents(t, m, map[string]interface{}{"a": 10, "b": 20, "c": 30})
+}
+
+func TestMarshalJSONSubset(t *testing.T) {
+	clock := newFakeClock()
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, Clock: clock})
+	m.Set("a", 1)
+	m.SetWithTTL("b", 2, time.Second)
+	m.SetWithTTL("c", 3, time.Hour)
+	clock.Advance(time.Minute)
+	data, err := m.MarshalJSONSubset([]string{"a", "b", "c", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"a":1,"c":3}` {
+		t.Fatalf("MarshalJSONSubset = %s", data)
+	}
+}
+
+func TestIterRoundRobin(t *testing.T) {
+	m := NewConcurrentMapString(8)
+	for i := 0; i < 1000; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	seen := make(map[int]bool)
+	n := 0
+	for tuple := range m.IterRoundRobin() {
+		if n < m.ShardCount() {
+			shard := m.GetShardIndex(tuple.Key)
+			if seen[shard] {
+				t.Fatalf("element %d is from shard %d again", n, shard)
+			}
+			seen[shard] = true
+		}
+		n++
+	}
+	if n != 1000 {
+		t.Fatalf("IterRoundRobin yielded %d elements, want 1000", n)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	if err := m.Append("list", 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Append("list", 3); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m.Get("list"); !reflect.DeepEqual(v, []interface{}{1, 2, 3}) {
+		t.Fatalf("Get(list) = %v, want [1 2 3]", v)
+	}
+	m.Set("scalar", 1)
+	if err := m.Append("scalar", 2); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("Append to a non-slice = %v, want ErrTypeMismatch", err)
+	}
+	if v, _ := m.Get("scalar"); v != 1 {
+		t.Fatalf("Append replaced a non-slice value by %v", v)
+	}
+}
+
+func TestShardItems(t *testing.T) {
+	m := NewConcurrentMapString(8)
+	for i := 0; i < 200; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	union := make(map[string]interface{})
+	for i := 0; i < m.ShardCount(); i++ {
+		items, err := m.ShardItems(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, v := range items {
+			if _, ok := union[key]; ok {
+				t.Fatalf("key %s in two shards", key)
+			}
+			union[key] = v
+		}
+	}
+	if !reflect.DeepEqual(union, m.Items()) {
+		t.Fatal("the union of the shards differs from Items()")
+	}
+	if _, err := m.ShardItems(m.ShardCount()); err == nil {
+		t.Fatal("ShardItems accepted an index out of range")
+	}
+}
+
+func TestUpdateField(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	m.Set("record", map[string]interface{}{"name": "a", "age": 1})
+	m.Set("scalar", 1)
+	if !m.UpdateField("record", "age", 2) {
+		t.Fatal("UpdateField failed on a record")
+	}
+	if v, _ := m.Get("record"); !reflect.DeepEqual(v, map[string]interface{}{"name": "a", "age": 2}) {
+		t.Fatalf("Get(record) = %v", v)
+	}
+	if m.UpdateField("missing", "age", 2) {
+		t.Fatal("UpdateField succeeded on a missing key")
+	}
+	if m.UpdateField("scalar", "age", 2) {
+		t.Fatal("UpdateField succeeded on a non-map value")
+	}
+	if v, _ := m.Get("scalar"); v != 1 {
+		t.Fatalf("UpdateField changed a non-map value to %v", v)
+	}
+}
+
+func TestIterCbParallel(t *testing.T) {
+	m := NewConcurrentMapString(8)
+	for i := 0; i < 1000; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	var mu sync.Mutex
+	visits := make(map[string]int)
+	m.IterCbParallel(8, func(key string, v interface{}) {
+		mu.Lock()
+		visits[key]++
+		mu.Unlock()
+	})
+	if len(visits) != 1000 {
+		t.Fatalf("IterCbParallel visited %d keys, want 1000", len(visits))
+	}
+	for key, n := range visits {
+		if n != 1 {
+			t.Fatalf("key %s visited %d times", key, n)
+		}
+	}
+}
+
+func TestKeyNormalizer(t *testing.T) {
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, KeyNormalizer: strings.ToLower})
+	m.Set("Foo", 1)
+	m.Set("FOO", 2)
+	if v, ok := m.Get("foo"); !ok || v != 2 {
+		t.Fatalf("Get(foo) = %v, %v, want 2", v, ok)
+	}
+	if !m.Has("fOo") {
+		t.Fatal("Has(fOo) = false")
+	}
+	if keys := m.Keys(); !reflect.DeepEqual(keys, []string{"foo"}) {
+		t.Fatalf("Keys() = %v, want the normalized key only", keys)
+	}
+	for tuple := range m.IterBuffered() {
+		if tuple.Key != "foo" {
+			t.Fatalf("IterBuffered yielded %q", tuple.Key)
+		}
+	}
+	m.Remove("FoO")
+	if m.Count() != 0 {
+		t.Fatal("Remove(FoO) left the key")
+	}
+}
+
+func TestCountConcurrent(t *testing.T) {
+	m := NewConcurrentMapString(8)
+	wg := sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := strconv.Itoa(w) + "-" + strconv.Itoa(i)
+				m.Set(key, i)
+				m.Set(key, i+1) //an update, not an insertion
+				m.SetIfAbsent(key, 0)
+				m.Upsert(key, i, func(exist bool, old, new interface{}) interface{} { return new })
+				if i%2 == 0 {
+					m.Remove(key)
+					m.Remove(key)
+				} else if i%3 == 0 {
+					m.Pop(key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	want := 0
+	for i := 0; i < 500; i++ {
+		if i%2 != 0 && i%3 != 0 {
+			want += 8
+		}
+	}
+	if m.Count() != want {
+		t.Fatalf("Count() = %d, want %d", m.Count(), want)
+	}
+	if n := len(m.Items()); n != want {
+		t.Fatalf("Items() has %d entries, want %d", n, want)
+	}
+}
+
+func TestRange(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	visited := make(map[string]interface{})
+	m.Range(func(key string, v interface{}) bool {
+		visited[key] = v
+		return true
+	})
+	if !reflect.DeepEqual(visited, m.Items()) {
+		t.Fatal("Range did not visit every entry")
+	}
+	n := 0
+	m.Range(func(key string, v interface{}) bool {
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatalf("Range went on for %d entries after fn returned false", n-10)
+	}
+}
+
+func TestReplaceAllIsAtomicForReaders(t *testing.T) {
+	datasets := make([]map[string]interface{}, 2)
+	for d := range datasets {
+		datasets[d] = make(map[string]interface{})
+		for i := 0; i < 100; i++ {
+			datasets[d][strconv.Itoa(d)+"-"+strconv.Itoa(i)] = d
+		}
+	}
+	m := NewConcurrentMapString(8)
+	m.ReplaceAll(datasets[0])
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			m.ReplaceAll(datasets[i%2])
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		items := m.Items()
+		if !reflect.DeepEqual(items, datasets[0]) && !reflect.DeepEqual(items, datasets[1]) {
+			close(stop)
+			t.Fatalf("a reader saw a mixed or partial dataset of %d entries", len(items))
+		}
+	}
+	close(stop)
+	<-done
+}
+
+func TestHashDistribution(t *testing.T) {
+	m := NewConcurrentMapString(8)
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = "user:" + strconv.Itoa(i)
+	}
+	dist := m.HashDistribution(keys)
+	sum := 0
+	for shard, n := range dist {
+		if shard < 0 || shard >= 8 {
+			t.Fatalf("shard index %d out of range", shard)
+		}
+		want := 0
+		for _, key := range keys {
+			if m.GetShardIndex(key) == shard {
+				want++
+			}
+		}
+		if n != want {
+			t.Fatalf("shard %d has %d keys, GetShardIndex puts %d there", shard, n, want)
+		}
+		sum += n
+	}
+	if sum != len(keys) {
+		t.Fatalf("the distribution sums to %d, want %d", sum, len(keys))
+	}
+	if m.Count() != 0 {
+		t.Fatal("HashDistribution modified the map")
+	}
+}
+
+func TestMaxValueBytes(t *testing.T) {
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{
+		ShardCount:    4,
+		MaxValueBytes: 8,
+		Sizer: func(v interface{}) int {
+			return len(v.(string))
+		},
+	})
+	if err := m.SetChecked("small", "12345678"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetChecked("big", "123456789"); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("SetChecked of an oversized value = %v, want ErrValueTooLarge", err)
+	}
+	m.Set("small", "123456789")
+	checkContents(t, m, map[string]interface{}{"small": "12345678"})
+}
+
+func TestConsistentHashRemapsFewKeys(t *testing.T) {
+	moved := func(consistent bool) int {
+		m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 8, ConsistentHash: consistent})
+		before := make([]int, 10000)
+		for i := range before {
+			before[i] = m.indexOf("key-"+strconv.Itoa(i), 8)
+		}
+		n := 0
+		for i := range before {
+			if m.indexOf("key-"+strconv.Itoa(i), 9) != before[i] {
+				n++
+			}
+		}
+		return n
+	}
+	if n := moved(true); n > 2500 {
+		t.Fatalf("adding a shard to the ring moved %d of 10000 keys", n)
+	}
+	if n := moved(false); n < 7500 {
+		t.Fatalf("adding a shard under modulo moved only %d of 10000 keys", n)
+	}
+}
+
+func TestConcurrentMapImplementations(t *testing.T) {
+	for name, m := range map[string]ConcurrentMap{
+		"ConcurrentMapString": NewConcurrentMapString(4),
+		"MyMap":               NewMyMap(),
+	} {
+		m.Set("a", 1)
+		m.Set("b", 2)
+		m.Remove("b")
+		if v, ok := m.Get("a"); !ok || v != 1 {
+			t.Fatalf("%s: Get(a) = %v, %v", name, v, ok)
+		}
+		if m.Has("b") || m.Count() != 1 {
+			t.Fatalf("%s: Remove(b) left %d entries", name, m.Count())
+		}
+		if keys := m.Keys(); !reflect.DeepEqual(keys, []string{"a"}) {
+			t.Fatalf("%s: Keys() = %v", name, keys)
+		}
+		n := 0
+		m.IterCb(func(key string, v interface{}) {
+			n++
+		})
+		if n != 1 {
+			t.Fatalf("%s: IterCb visited %d entries", name, n)
+		}
+	}
+}
+
+func TestSample(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	for _, n := range []int{0, 10, 100, 150} {
+		sample := m.Sample(n)
+		want := n
+		if want > m.Count() {
+			want = m.Count()
+		}
+		if len(sample) != want {
+			t.Fatalf("Sample(%d) has %d entries, want %d", n, len(sample), want)
+		}
+		seen := make(map[string]bool)
+		for _, tuple := range sample {
+			if v, ok := m.Get(tuple.Key); !ok || v != tuple.Val || seen[tuple.Key] {
+				t.Fatalf("Sample(%d) returned %v", n, tuple)
+			}
+			seen[tuple.Key] = true
+		}
+	}
+}
+
+func TestKeysCb(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	keys := make(map[string]bool)
+	m.KeysCb(func(key string) bool {
+		keys[key] = true
+		return true
+	})
+	if len(keys) != 100 {
+		t.Fatalf("KeysCb yielded %d keys, want 100", len(keys))
+	}
+	n := 0
+	m.KeysCb(func(key string) bool {
+		n++
+		return n < 5
+	})
+	if n != 5 {
+		t.Fatalf("KeysCb went on for %d keys after fn returned false", n-5)
+	}
+}
+
+func TestSwapShardContents(t *testing.T) {
+	m := NewConcurrentMapString(1)
+	m.Set("before", 1)
+	old := m.SwapShardContents(0)
+	m.Set("after", 2)
+	if !reflect.DeepEqual(old, map[string]interface{}{"before": 1}) {
+		t.Fatalf("SwapShardContents returned %v", old)
+	}
+	checkContents(t, m, map[string]interface{}{"after": 2})
+	if m.SwapShardContents(1) != nil {
+		t.Fatal("SwapShardContents accepted an index out of range")
+	}
+}
+
+func TestTypeGuard(t *testing.T) {
+	guarded := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, TypeGuard: true})
+	guarded.Set("a", 1)
+	if err := guarded.SetChecked("a", "one"); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("SetChecked with another type = %v, want ErrTypeMismatch", err)
+	}
+	guarded.Set("a", "one")
+	guarded.Upsert("a", nil, func(exist bool, old, new interface{}) interface{} { return "two" })
+	if err := guarded.SetChecked("a", 2); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, guarded, map[string]interface{}{"a": 2})
+
+	m := NewConcurrentMapString(4)
+	m.Set("a", 1)
+	if err := m.SetChecked("a", "one"); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, m, map[string]interface{}{"a": "one"})
+
+	panicking := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, TypeGuard: true, TypeGuardPanic: true})
+	panicking.Set("a", 1)
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("TypeGuardPanic did not panic")
+		}
+	}()
+	panicking.Set("a", "one")
+}
+
+func TestMPop(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	for i := 0; i < 20; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	popped := m.MPop([]string{"1", "5", "12", "missing", "19"})
+	if !reflect.DeepEqual(popped, map[string]interface{}{"1": 1, "5": 5, "12": 12, "19": 19}) {
+		t.Fatalf("MPop returned %v", popped)
+	}
+	for key := range popped {
+		if m.Has(key) {
+			t.Fatalf("MPop left %s in the map", key)
+		}
+	}
+	if m.Count() != 16 {
+		t.Fatalf("Count() = %d, want 16", m.Count())
+	}
+}
+
+func TestGetNonBlocking(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	m.Set("a", 1)
+	if v, ok, acquired := m.GetNonBlocking("a"); v != 1 || !ok || !acquired {
+		t.Fatalf("GetNonBlocking(a) = %v, %v, %v", v, ok, acquired)
+	}
+	shard := m.lockShard("a")
+	withinSecond(t, "GetNonBlocking", func() {
+		if _, ok, acquired := m.GetNonBlocking("a"); ok || acquired {
+			t.Errorf("GetNonBlocking on a write locked shard = %v, %v", ok, acquired)
+		}
+	})
+	shard.Unlock()
+}
+
+func TestDeterministicHasherGolden(t *testing.T) {
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 32, Hasher: DeterministicHasher})
+	for _, golden := range []struct {
+		key   string
+		hash  uint32
+		shard int
+	}{
+		{"", 2166136261, 5},
+		{"a", 0x050c5d7e, 30},
+		{"foo", 1083137555, 19},
+		{"user:42", 4160126384, 16},
+		{"hello world", 1418570095, 15},
+	} {
+		if h := DeterministicHasher(golden.key); h != golden.hash {
+			t.Fatalf("DeterministicHasher(%q) = %d, want %d", golden.key, h, golden.hash)
+		}
+		if i := m.GetShardIndex(golden.key); i != golden.shard {
+			t.Fatalf("GetShardIndex(%q) = %d, want %d", golden.key, i, golden.shard)
+		}
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	for _, shardCount := range []int{1, 4} {
+		m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: shardCount, Ordered: true})
+		var want []string
+		for i := 0; i < 50; i++ {
+			key := strconv.Itoa((i * 37) % 101)
+			m.Set(key, i)
+		}
+		m.Set("3", "updated") //an update keeps the position
+		m.Remove("37")
+		for i := 0; i < shardCount; i++ {
+			for j := 0; j < 50; j++ {
+				key := strconv.Itoa((j * 37) % 101)
+				if key != "37" && m.GetShardIndex(key) == i {
+					want = append(want, key)
+				}
+			}
+		}
+		if keys := m.Keys(); !reflect.DeepEqual(keys, want) {
+			t.Fatalf("%d shards: Keys() = %v, want %v", shardCount, keys, want)
+		}
+		var iterated []string
+		for tuple := range m.IterBuffered() {
+			iterated = append(iterated, tuple.Key)
+		}
+		if !reflect.DeepEqual(iterated, want) {
+			t.Fatalf("%d shards: IterBuffered yielded %v, want %v", shardCount, iterated, want)
+		}
+	}
+}
+
+func TestGetOrCreateSubMap(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	subs := make([]*ConcurrentMapString, 16)
+	wg := sync.WaitGroup{}
+	for i := range subs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			subs[i] = m.GetOrCreateSubMap("outer", 2)
+			subs[i].Set(strconv.Itoa(i), i)
+		}(i)
+	}
+	wg.Wait()
+	for _, sub := range subs {
+		if sub == nil || sub != subs[0] {
+			t.Fatal("GetOrCreateSubMap returned different inner maps")
+		}
+	}
+	if subs[0].Count() != len(subs) {
+		t.Fatalf("the inner map has %d entries, want %d", subs[0].Count(), len(subs))
+	}
+	m.Set("scalar", 1)
+	if m.GetOrCreateSubMap("scalar", 2) != nil {
+		t.Fatal("GetOrCreateSubMap returned a map for a non-map value")
+	}
+}
+
+func TestMaxByAndMinBy(t *testing.T) {
+	less := func(a, b interface{}) bool { return a.(int) < b.(int) }
+	m := NewConcurrentMapString(4)
+	if _, _, ok := m.MaxBy(less); ok {
+		t.Fatal("MaxBy found an entry in an empty map")
+	}
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), (i*37)%100)
+	}
+	if key, v, ok := m.MaxBy(less); !ok || v != 99 || key != "27" {
+		t.Fatalf("MaxBy = %s, %v, %v, want 27, 99", key, v, ok)
+	}
+	if key, v, ok := m.MinBy(less); !ok || v != 0 || key != "0" {
+		t.Fatalf("MinBy = %s, %v, %v, want 0, 0", key, v, ok)
+	}
+}
+
+func TestSnapshotConsistent(t *testing.T) {
+	m := NewConcurrentMapString(8)
+	keys := []string{"a", "b", "c", "d"}
+	for _, key := range keys {
+		m.Set(key, 100)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		//moves one unit between two keys, the total stays 400
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			from, to := keys[i%4], keys[(i+1)%4]
+			snapshot := m.Items()
+			m.CompareAndSwapMany([]CasTuple{
+				{Key: from, Old: snapshot[from], New: snapshot[from].(int) - 1},
+				{Key: to, Old: snapshot[to], New: snapshot[to].(int) + 1},
+			})
+		}
+	}()
+	for i := 0; i < 500; i++ {
+		total := 0
+		for _, v := range m.SnapshotConsistent() {
+			total += v.(int)
+		}
+		if total != 400 {
+			close(stop)
+			t.Fatalf("snapshot total %d, a cross-shard update was seen half applied", total)
+		}
+	}
+	close(stop)
+	<-done
+}
+
+func TestGetOrSetTyped(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	if v, loaded := m.GetOrSetString("s", "first"); loaded || v != "first" {
+		t.Fatalf("GetOrSetString stored %q, %v", v, loaded)
+	}
+	if v, loaded := m.GetOrSetString("s", "second"); !loaded || v != "first" {
+		t.Fatalf("GetOrSetString loaded %q, %v", v, loaded)
+	}
+	if v, loaded := m.GetOrSetInt("i", 1); loaded || v != 1 {
+		t.Fatalf("GetOrSetInt stored %d, %v", v, loaded)
+	}
+	if v, loaded := m.GetOrSetInt("i", 2); !loaded || v != 1 {
+		t.Fatalf("GetOrSetInt loaded %d, %v", v, loaded)
+	}
+	checkContents(t, m, map[string]interface{}{"s": "first", "i": 1})
+}
+
+func TestCompareAndSwapFunc(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	m.Set("list", []int{1, 2})
+	eq := func(a, b interface{}) bool { return reflect.DeepEqual(a, b) }
+	if m.CompareAndSwapFunc("list", []int{1, 3}, []int{9}, eq) {
+		t.Fatal("CompareAndSwapFunc swapped a mismatching slice")
+	}
+	if !m.CompareAndSwapFunc("list", []int{1, 2}, []int{1, 2, 3}, eq) {
+		t.Fatal("CompareAndSwapFunc did not swap a matching slice")
+	}
+	if v, _ := m.Get("list"); !reflect.DeepEqual(v, []int{1, 2, 3}) {
+		t.Fatalf("Get(list) = %v", v)
+	}
+	if m.CompareAndSwapFunc("missing", nil, 1, eq) {
+		t.Fatal("CompareAndSwapFunc swapped a missing key")
+	}
+}
+
+func TestZeroValueMap(t *testing.T) {
+	var m ConcurrentMapString
+	m.Set("a", 1)
+	if v, ok := m.Get("a"); !ok || v != 1 {
+		t.Fatalf("Get(a) = %v, %v on a zero value map", v, ok)
+	}
+	if m.ShardCount() != DEFAULT_SHARD_COUNT || m.Count() != 1 {
+		t.Fatalf("zero value map has %d shards and %d entries", m.ShardCount(), m.Count())
+	}
+
+	var nilMap *ConcurrentMapString
+	defer func() {
+		r := recover()
+		if r == nil || !strings.Contains(fmt.Sprint(r), "NewConcurrentMapString") {
+			t.Fatalf("nil map panicked with %v, want the constructor named", r)
+		}
+	}()
+	nilMap.Set("a", 1)
+}
+
+func TestRepairPlacement(t *testing.T) {
+	m := NewConcurrentMapString(8)
+	m.Set("a", 1)
+	misplaced := "b"
+	for i := 0; m.GetShardIndex(misplaced) == m.GetShardIndex("a"); i++ {
+		misplaced = "b" + strconv.Itoa(i)
+	}
+	m.WithShard("a", func(items map[string]interface{}) {
+		items[misplaced] = 2
+	})
+	if keys := m.VerifyPlacement(); !reflect.DeepEqual(keys, []string{misplaced}) {
+		t.Fatalf("VerifyPlacement() = %v, want [%s]", keys, misplaced)
+	}
+	if m.Has(misplaced) {
+		t.Fatal("a misplaced key is visible")
+	}
+	if n := m.RepairPlacement(); n != 1 {
+		t.Fatalf("RepairPlacement() = %d, want 1", n)
+	}
+	if len(m.VerifyPlacement()) != 0 {
+		t.Fatal("keys still misplaced after RepairPlacement")
+	}
+	checkContents(t, m, map[string]interface{}{"a": 1, misplaced: 2})
+}
+
+func TestTopN(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	for i := 0; i < 100; i++ {
+		m.Set("player"+strconv.Itoa(i), (i*37)%100)
+	}
+	top := m.TopN(3, func(a, b interface{}) bool { return a.(int) < b.(int) })
+	want := []TupleString{{"player27", 99}, {"player54", 98}, {"player81", 97}}
+	if !reflect.DeepEqual(top, want) {
+		t.Fatalf("TopN(3) = %v, want %v", top, want)
+	}
+	if n := len(m.TopN(1000, func(a, b interface{}) bool { return a.(int) < b.(int) })); n != 100 {
+		t.Fatalf("TopN(1000) returned %d entries", n)
+	}
+}
+
+func TestEstimateCount(t *testing.T) {
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, CountRefreshInterval: 20 * time.Millisecond})
+	if n := m.EstimateCount(); n != 0 {
+		t.Fatalf("EstimateCount() = %d on an empty map", n)
+	}
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	waitFor(t, "EstimateCount to reflect the inserts", func() bool { return m.EstimateCount() == 100 })
+}
+
+func TestMapValues(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	want := make(map[string]interface{})
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+		want[strconv.Itoa(i)] = 2 * i
+	}
+	m.MapValues(func(key string, v interface{}) interface{} {
+		return 2 * v.(int)
+	})
+	checkContents(t, m, want)
+}
+
+func TestMarshalPage(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	for i := 0; i < 25; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	type page struct {
+		Total int
+		Items []struct {
+			Key   string
+			Value float64
+		}
+	}
+	seen := make(map[string]int)
+	last := ""
+	for offset := 0; offset < 30; offset += 10 {
+		data, err := m.MarshalPage(offset, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p page
+		if err := json.Unmarshal(data, &p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Total != 25 {
+			t.Fatalf("total %d, want 25", p.Total)
+		}
+		for _, item := range p.Items {
+			if item.Key <= last {
+				t.Fatalf("%q after %q, pages are not sorted by key", item.Key, last)
+			}
+			last = item.Key
+			seen[item.Key]++
+			if strconv.Itoa(int(item.Value)) != item.Key {
+				t.Fatalf("page item %v", item)
+			}
+		}
+	}
+	if len(seen) != 25 {
+		t.Fatalf("the pages cover %d entries, want 25", len(seen))
+	}
+}
+
+func TestErrors(t *testing.T) {
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, MaxValueBytes: 4, TypeGuard: true, MaxEntries: 1})
+	if err := m.SetChecked("a", "too long"); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("oversized value: %v", err)
+	}
+	m.Set("a", 1)
+	if err := m.SetChecked("a", "x"); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("type change: %v", err)
+	}
+	if err := m.SetChecked("b", 1); !errors.Is(err, ErrMapFull) {
+		t.Fatalf("full map: %v", err)
+	}
+
+	backend := errors.New("backend down")
+	loading := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{
+		ShardCount: 4,
+		Loader: func(key string) (interface{}, bool, error) {
+			return nil, false, backend
+		},
+	})
+	_, _, err := loading.GetOrLoad("k")
+	var loaderErr *LoaderError
+	if !errors.Is(err, ErrLoaderFailed) || !errors.Is(err, backend) || !errors.As(err, &loaderErr) || loaderErr.Key != "k" {
+		t.Fatalf("failing loader: %v", err)
+	}
+}
+
+func TestSerialIterMatchesFanOut(t *testing.T) {
+	serial := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 8, SerialIterThreshold: 1 << 20})
+	fanOut := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 8, SerialIterThreshold: -1})
+	for i := 0; i < 100; i++ {
+		serial.Set(strconv.Itoa(i), i)
+		fanOut.Set(strconv.Itoa(i), i)
+	}
+	if !serial.iterSerially() || fanOut.iterSerially() {
+		t.Fatal("SerialIterThreshold not applied")
+	}
+	if !reflect.DeepEqual(serial.Items(), fanOut.Items()) {
+		t.Fatal("Items() differs")
+	}
+	sortedKeys := func(m *ConcurrentMapString) []string {
+		keys := m.Keys()
+		sort.Strings(keys)
+		return keys
+	}
+	if !reflect.DeepEqual(sortedKeys(serial), sortedKeys(fanOut)) {
+		t.Fatal("Keys() differs")
+	}
+	iterated := func(m *ConcurrentMapString) map[string]interface{} {
+		items := make(map[string]interface{})
+		for tuple := range m.IterBuffered() {
+			items[tuple.Key] = tuple.Val
+		}
+		return items
+	}
+	if !reflect.DeepEqual(iterated(serial), iterated(fanOut)) {
+		t.Fatal("IterBuffered differs")
+	}
+}
+
+func benchmarkSmallMapIter(b *testing.B, threshold int) {
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 32, SerialIterThreshold: threshold})
+	for i := 0; i < 50; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for range m.IterBuffered() {
+		}
+	}
+}
+
+func BenchmarkSmallMapIterSerial(b *testing.B) { benchmarkSmallMapIter(b, 0) }
+func BenchmarkSmallMapIterFanOut(b *testing.B) { benchmarkSmallMapIter(b, -1) }
+
+func TestViewConcurrentWithWriters(t *testing.T) {
+	type record struct {
+		Name  string
+		Score int
+	}
+	m := NewConcurrentMapString(4)
+	m.Set("r", &record{"a", 0})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 1000; i++ {
+			m.Set("r", &record{"a", i})
+		}
+	}()
+	last := -1
+	for i := 0; i < 1000; i++ {
+		m.View("r", func(v interface{}, exists bool) {
+			r := v.(*record)
+			if !exists || r.Name != "a" || r.Score < last {
+				t.Fatalf("View saw %v, %v after score %d", r, exists, last)
+			}
+			last = r.Score
+		})
+	}
+	<-done
+	m.View("missing", func(v interface{}, exists bool) {
+		if exists || v != nil {
+			t.Fatalf("View(missing) got %v, %v", v, exists)
+		}
+	})
+}
+
+func TestWeightedSample(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	if _, ok := m.WeightedSample(func(v interface{}) float64 { return 1 }); ok {
+		t.Fatal("WeightedSample picked from an empty map")
+	}
+	weights := map[string]float64{"a": 1, "b": 2, "c": 7, "zero": 0}
+	for key, w := range weights {
+		m.Set(key, w)
+	}
+	const draws = 20000
+	counts := make(map[string]int)
+	for i := 0; i < draws; i++ {
+		key, ok := m.WeightedSample(func(v interface{}) float64 { return v.(float64) })
+		if !ok {
+			t.Fatal("WeightedSample failed")
+		}
+		counts[key]++
+	}
+	for key, w := range weights {
+		got := float64(counts[key]) / draws
+		if want := w / 10; math.Abs(got-want) > 0.02 {
+			t.Fatalf("%s drawn %.3f of the time, want %.3f", key, got, want)
+		}
+	}
+}
+
+func TestTypeHistogram(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	m.MSet(map[string]interface{}{"i1": 1, "i2": 2, "s": "x", "f": 1.5, "nil": nil, "slice": []int{1}})
+	want := map[string]int{"int": 2, "string": 1, "float64": 1, "nil": 1, "[]int": 1}
+	if h := m.TypeHistogram(); !reflect.DeepEqual(h, want) {
+		t.Fatalf("TypeHistogram() = %v, want %v", h, want)
+	}
+}
+
+func TestGetAndMaybeDelete(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	m.Set("stale", 1)
+	m.Set("fresh", 2)
+	isStale := func(v interface{}) bool { return v.(int) == 1 }
+	if v, deleted, exists := m.GetAndMaybeDelete("stale", isStale); v != 1 || !deleted || !exists {
+		t.Fatalf("GetAndMaybeDelete(stale) = %v, %v, %v", v, deleted, exists)
+	}
+	if v, deleted, exists := m.GetAndMaybeDelete("fresh", isStale); v != 2 || deleted || !exists {
+		t.Fatalf("GetAndMaybeDelete(fresh) = %v, %v, %v", v, deleted, exists)
+	}
+	if v, deleted, exists := m.GetAndMaybeDelete("missing", isStale); v != nil || deleted || exists {
+		t.Fatalf("GetAndMaybeDelete(missing) = %v, %v, %v", v, deleted, exists)
+	}
+	checkContents(t, m, map[string]interface{}{"fresh": 2})
+}
+
+func TestAutoShardCount(t *testing.T) {
+	for _, tc := range []struct{ procs, want int }{
+		{1, minAutoShardCount},
+		{2, minAutoShardCount},
+		{3, 16},
+		{8, 32},
+		{12, 64},
+		{1000, maxAutoShardCount},
+	} {
+		if got := autoShardCount(tc.procs); got != tc.want {
+			t.Fatalf("autoShardCount(%d) = %d, want %d", tc.procs, got, tc.want)
+		}
+	}
+	n := NewConcurrentMapStringAuto().ShardCount()
+	if n < minAutoShardCount || n > maxAutoShardCount || n&(n-1) != 0 || (n < 4*runtime.GOMAXPROCS(0) && n != maxAutoShardCount) {
+		t.Fatalf("NewConcurrentMapStringAuto has %d shards for GOMAXPROCS %d", n, runtime.GOMAXPROCS(0))
+	}
+}
+
+func TestPartition(t *testing.T) {
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, KeyNormalizer: strings.ToLower})
+	m.MSet(map[string]interface{}{"a": 1, "b": 2, "c": 3})
+	present, missing := m.Partition([]string{"A", "b", "x", "y"})
+	if !reflect.DeepEqual(present, map[string]interface{}{"a": 1, "b": 2}) {
+		t.Fatalf("present = %v", present)
+	}
+	sort.Strings(missing)
+	if !reflect.DeepEqual(missing, []string{"x", "y"}) {
+		t.Fatalf("missing = %v", missing)
+	}
+	if present, missing := m.Partition(nil); len(present) != 0 || len(missing) != 0 {
+		t.Fatalf("Partition(nil) = %v, %v", present, missing)
+	}
+}
+
+func TestGetCopy(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	m.Set("s", []int{1, 2, 3})
+	clone := func(v interface{}) interface{} {
+		return append([]int(nil), v.([]int)...)
+	}
+	v, ok := m.GetCopy("s", clone)
+	if !ok {
+		t.Fatal("GetCopy missed a present key")
+	}
+	v.([]int)[0] = 100
+	if stored, _ := m.Get("s"); stored.([]int)[0] != 1 {
+		t.Fatalf("mutating the copy changed the stored value to %v", stored)
+	}
+	if v, _ := m.GetCopy("s", nil); v.([]int)[0] != 1 {
+		t.Fatalf("GetCopy(nil) = %v", v)
+	}
+	if v, ok := m.GetCopy("missing", clone); ok || v != nil {
+		t.Fatalf("GetCopy(missing) = %v, %v", v, ok)
+	}
+}
+
+func TestCountParallel(t *testing.T) {
+	for _, shards := range []int{1, 3, 32, 4096} {
+		m := NewConcurrentMapString(shards)
+		for i := 0; i < 5000; i++ {
+			m.Set(strconv.Itoa(i), i)
+		}
+		if got, want := m.CountParallel(), m.Count(); got != want || want != 5000 {
+			t.Fatalf("%d shards: CountParallel() = %d, Count() = %d", shards, got, want)
+		}
+	}
+}
+
+func benchmarkCount(b *testing.B, count func(m *ConcurrentMapString) int) {
+	for _, shards := range []int{32, 65536} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			m := NewConcurrentMapString(shards)
+			for i := 0; i < 1000; i++ {
+				m.Set(strconv.Itoa(i), i)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				count(m)
+			}
+		})
+	}
+}
+
+func BenchmarkCount(b *testing.B) {
+	benchmarkCount(b, (*ConcurrentMapString).Count)
+}
+
+func BenchmarkCountParallel(b *testing.B) {
+	benchmarkCount(b, (*ConcurrentMapString).CountParallel)
+}
+
+func TestReplaceShard(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	idx := m.GetShardIndex("0")
+	var mine, other []string
+	for i := 0; i < 100; i++ {
+		if key := strconv.Itoa(i); m.GetShardIndex(key) == idx {
+			mine = append(mine, key)
+		} else {
+			other = append(other, key)
+		}
+	}
+
+	if err := m.ReplaceShard(idx, map[string]interface{}{mine[0]: "new", other[0]: "x"}); err == nil {
+		t.Fatal("ReplaceShard accepted a key of another shard")
+	}
+	if err := m.ReplaceShard(4, nil); err == nil {
+		t.Fatal("ReplaceShard accepted an index out of range")
+	}
+	if m.Count() != 100 {
+		t.Fatalf("a rejected ReplaceShard changed the map, Count() = %d", m.Count())
+	}
+
+	if err := m.ReplaceShard(idx, map[string]interface{}{mine[0]: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	items, _ := m.ShardItems(idx)
+	if !reflect.DeepEqual(items, map[string]interface{}{mine[0]: "new"}) {
+		t.Fatalf("ShardItems() = %v after ReplaceShard", items)
+	}
+	if m.Has(mine[1]) {
+		t.Fatalf("%s survived the replacement of its shard", mine[1])
+	}
+	for _, key := range other {
+		if !m.Has(key) {
+			t.Fatalf("%s of another shard was removed", key)
+		}
+	}
+	if m.Count() != len(other)+1 {
+		t.Fatalf("Count() = %d, want %d", m.Count(), len(other)+1)
+	}
+}
+
+func TestRemovePrefix(t *testing.T) {
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, SmallShardSize: 4})
+	want := make(map[string]interface{})
+	for i := 0; i < 50; i++ {
+		m.Set("user:"+strconv.Itoa(i), i)
+		m.Set("session:"+strconv.Itoa(i), i)
+		want["session:"+strconv.Itoa(i)] = i
+	}
+	if n := m.RemovePrefix("user:"); n != 50 {
+		t.Fatalf("RemovePrefix() = %d, want 50", n)
+	}
+	checkContents(t, m, want)
+	if n := m.RemovePrefix("nothing"); n != 0 {
+		t.Fatalf("RemovePrefix() of no key = %d", n)
+	}
+	if n := m.RemovePrefix(""); n != 50 || m.Count() != 0 {
+		t.Fatalf("RemovePrefix(\"\") = %d, left %d", n, m.Count())
+	}
+}
+
+func TestWithShardResult(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	idx := m.GetShardIndex("0")
+	var keys []string
+	for i := 0; len(keys) < 5; i++ {
+		if key := strconv.Itoa(i); m.GetShardIndex(key) == idx {
+			keys = append(keys, key)
+			m.Set(key, i)
+		}
+	}
+	want := 0
+	for _, key := range keys[:3] {
+		v, _ := m.Get(key)
+		want += v.(int)
+	}
+	sum := m.WithShardResult(keys[0], func(items map[string]interface{}) interface{} {
+		total := 0
+		for _, key := range keys[:3] {
+			total += items[key].(int)
+		}
+		items[keys[4]] = total
+		return total
+	})
+	if sum != want {
+		t.Fatalf("WithShardResult() = %v, want %d", sum, want)
+	}
+	if v, _ := m.Get(keys[4]); v != want {
+		t.Fatalf("the write in fn stored %v, want %d", v, want)
+	}
+}
+
+func TestTransformOrDelete(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	want := make(map[string]interface{})
+	for i := -10; i < 10; i++ {
+		m.Set(strconv.Itoa(i), i)
+		if i >= 0 {
+			want[strconv.Itoa(i)] = i + 1
+		}
+	}
+	m.TransformOrDelete(func(key string, v interface{}) (interface{}, bool) {
+		return v.(int) + 1, v.(int) >= 0
+	})
+	checkContents(t, m, want)
+}
+
+func TestToStructs(t *testing.T) {
+	type entry struct {
+		Name  string
+		Score int
+	}
+	m := NewConcurrentMapString(4)
+	m.MSet(map[string]interface{}{"a": 1, "b": 2, "c": 3})
+	structs := m.ToStructs(func(key string, v interface{}) interface{} {
+		return entry{key, v.(int)}
+	})
+	if len(structs) != 3 {
+		t.Fatalf("ToStructs() has %d entries, want 3", len(structs))
+	}
+	sort.Slice(structs, func(i, j int) bool {
+		return structs[i].(entry).Name < structs[j].(entry).Name
+	})
+	want := []interface{}{entry{"a", 1}, entry{"b", 2}, entry{"c", 3}}
+	if !reflect.DeepEqual(structs, want) {
+		t.Fatalf("ToStructs() = %v, want %v", structs, want)
+	}
+}
+
+func TestStats(t *testing.T) {
+	m := NewConcurrentMapString(8)
+	//skewed: most keys land in the shard of "0"
+	hot := m.GetShardIndex("0")
+	for i := 0; i < 300; i++ {
+		if key := strconv.Itoa(i); m.GetShardIndex(key) == hot || i%7 == 0 {
+			m.Set(key, i)
+		}
+	}
+	want := MapStats{Count: m.Count(), ShardCount: m.ShardCount()}
+	for i := 0; i < m.ShardCount(); i++ {
+		items, err := m.ShardItems(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := len(items)
+		if size == 0 {
+			want.EmptyShards++
+		}
+		if size > want.MaxShardSize {
+			want.MaxShardSize = size
+		}
+		if i == 0 || size < want.MinShardSize {
+			want.MinShardSize = size
+		}
+	}
+	if got := m.Stats(); got != want {
+		t.Fatalf("Stats() = %+v, want %+v", got, want)
+	}
+	if want.MaxShardSize <= want.MinShardSize {
+		t.Fatalf("the map is not skewed: %+v", want)
+	}
+}
+
+func TestIncrementBounded(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	for _, c := range []struct {
+		delta, max, want int64
+		applied          bool
+	}{
+		{3, 10, 3, true}, //created
+		{5, 10, 8, true},
+		{3, 10, 8, false}, //would exceed max
+		{2, 10, 10, true}, //up to max exactly
+		{-4, 10, 6, true},
+	} {
+		if got, applied := m.IncrementBounded("quota", c.delta, c.max); got != c.want || applied != c.applied {
+			t.Fatalf("IncrementBounded(%d, %d) = %d, %v, want %d, %v", c.delta, c.max, got, applied, c.want, c.applied)
+		}
+	}
+	if got, applied := m.IncrementBounded("over", 5, 4); got != 0 || applied || m.Has("over") {
+		t.Fatalf("IncrementBounded() of a missing key past max = %d, %v", got, applied)
+	}
+	m.Set("text", "x")
+	if _, applied := m.IncrementBounded("text", 1, 10); applied {
+		t.Fatal("IncrementBounded applied to a string")
+	}
+	if v, _ := m.Get("text"); v != "x" {
+		t.Fatalf("IncrementBounded changed a string to %v", v)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := NewConcurrentMapString(4)
+	old.MSet(map[string]interface{}{"same": []int{1}, "changed": 1, "removed": 1, "removed2": 2})
+	m := NewConcurrentMapString(8)
+	m.MSet(map[string]interface{}{"same": []int{1}, "changed": 2, "added": 1})
+	added, removed, changed := m.Diff(old, nil)
+	if !reflect.DeepEqual(added, []string{"added"}) || !reflect.DeepEqual(removed, []string{"removed", "removed2"}) ||
+		!reflect.DeepEqual(changed, []string{"changed"}) {
+		t.Fatalf("Diff() = %v, %v, %v", added, removed, changed)
+	}
+	//a custom eq decides what changed
+	_, _, changed = m.Diff(old, func(a, b interface{}) bool { return true })
+	if len(changed) != 0 {
+		t.Fatalf("Diff() with eq always true reported %v as changed", changed)
+	}
+}
+
+func TestHasAllBitset(t *testing.T) {
+	m := NewConcurrentMapString(16)
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		if i%3 != 0 {
+			m.Set(keys[i], i)
+		}
+	}
+	result := m.HasAllBitset(keys)
+	if len(result) != len(keys) {
+		t.Fatalf("HasAllBitset() has %d entries, want %d", len(result), len(keys))
+	}
+	for i, key := range keys {
+		if result[i] != m.Has(key) {
+			t.Fatalf("HasAllBitset()[%d] = %v, Has(%s) = %v", i, result[i], key, m.Has(key))
+		}
+	}
+	if len(m.HasAllBitset(nil)) != 0 {
+		t.Fatal("HasAllBitset(nil) is not empty")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	m.Set("a", 1)
+	increment := func(old interface{}, exists bool) (interface{}, bool) {
+		if !exists {
+			return 100, true
+		}
+		return old.(int) + 1, old.(int) < 2
+	}
+	if v, stored := m.Update("a", increment); v != 2 || !stored {
+		t.Fatalf("Update(a) = %v, %v, want 2, true", v, stored)
+	}
+	if v, stored := m.Update("a", increment); v != 2 || stored {
+		t.Fatalf("Update(a) = %v, %v, want the old 2, false", v, stored)
+	}
+	if v, _ := m.Get("a"); v != 2 {
+		t.Fatalf("Get(a) = %v after an Update not storing", v)
+	}
+	if v, stored := m.Update("b", increment); v != 100 || !stored {
+		t.Fatalf("Update(b) = %v, %v on a missing key", v, stored)
+	}
+	if v, stored := m.Update("c", func(old interface{}, exists bool) (interface{}, bool) {
+		return 1, false
+	}); v != nil || stored || m.Has("c") {
+		t.Fatalf("Update(c) = %v, %v, a missing key not stored", v, stored)
+	}
+}
+
+func TestMSetIfAbsent(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	m.MSet(map[string]interface{}{"a": 1, "c": 3})
+	inserted := m.MSetIfAbsent(map[string]interface{}{"a": -1, "b": 2, "c": -3, "d": 4})
+	sort.Strings(inserted)
+	if !reflect.DeepEqual(inserted, []string{"b", "d"}) {
+		t.Fatalf("MSetIfAbsent() = %v, want [b d]", inserted)
+	}
+	checkContents(t, m, map[string]interface{}{"a": 1, "b": 2, "c": 3, "d": 4})
+	if inserted := m.MSetIfAbsent(map[string]interface{}{"a": 0}); len(inserted) != 0 {
+		t.Fatalf("MSetIfAbsent() of present keys = %v", inserted)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	m.MSet(map[string]interface{}{"same": []int{1}, "changed": 1, "gone": 1, "gone2": 2})
+	desired := map[string]interface{}{"same": []int{1}, "changed": 2, "new": 3}
+	added, updated, removed := m.Reconcile(desired)
+	if !reflect.DeepEqual(added, []string{"new"}) || !reflect.DeepEqual(updated, []string{"changed"}) ||
+		!reflect.DeepEqual(removed, []string{"gone", "gone2"}) {
+		t.Fatalf("Reconcile() = %v, %v, %v", added, updated, removed)
+	}
+	if !reflect.DeepEqual(m.Items(), desired) {
+		t.Fatalf("the map holds %v after Reconcile, want %v", m.Items(), desired)
+	}
+	if added, updated, removed := m.Reconcile(desired); len(added)+len(updated)+len(removed) != 0 {
+		t.Fatalf("Reconcile() to the current state = %v, %v, %v", added, updated, removed)
+	}
+}
+
+// Meant for -race: the iterators read the shard tables while Resize swaps them.
+func TestIterBufferedConcurrentWithResize(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	const n = 1000
+	for i := 0; i < n; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	stop := make(chan struct{})
+	resized := make(chan struct{})
+	go func() {
+		defer close(resized)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			m.Resize(1 + i%16)
+		}
+	}()
+	for round := 0; round < 50; round++ {
+		seen := make(map[string]bool, n)
+		for tuple := range m.IterBuffered() {
+			if seen[tuple.Key] {
+				t.Fatalf("round %d: IterBuffered yielded %s twice", round, tuple.Key)
+			}
+			seen[tuple.Key] = true
+		}
+		if len(seen) != n {
+			t.Fatalf("round %d: IterBuffered yielded %d entries, want %d", round, len(seen), n)
+		}
+		if keys := m.Keys(); len(keys) != n {
+			t.Fatalf("round %d: Keys() has %d entries, want %d", round, len(keys), n)
+		}
+	}
+	close(stop)
+	<-resized
+}
+
+func TestMaxEntries(t *testing.T) {
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, MaxEntries: 10})
+	for i := 0; i < 10; i++ {
+		if err := m.SetChecked(strconv.Itoa(i), i); err != nil {
+			t.Fatalf("SetChecked(%d) below the cap: %v", i, err)
+		}
+	}
+	if err := m.SetChecked("new", 1); !errors.Is(err, ErrMapFull) {
+		t.Fatalf("SetChecked() on a full map = %v", err)
+	}
+	m.Set("new", 1)
+	if m.SetIfAbsent("new", 1) || m.Has("new") || m.Count() != 10 {
+		t.Fatalf("a full map took a new key, Count() = %d", m.Count())
+	}
+	//updates of present keys still go through, nothing was evicted
+	if err := m.SetChecked("0", -1); err != nil {
+		t.Fatalf("SetChecked() of a present key on a full map: %v", err)
+	}
+	for i := 1; i < 10; i++ {
+		if !m.Has(strconv.Itoa(i)) {
+			t.Fatalf("%d was evicted", i)
+		}
+	}
+	m.Remove("5")
+	if err := m.SetChecked("new", 1); err != nil {
+		t.Fatalf("SetChecked() after a Remove freed space: %v", err)
+	}
+	if err := m.SetChecked("newer", 1); !errors.Is(err, ErrMapFull) {
+		t.Fatalf("SetChecked() on the map full again = %v", err)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	a := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 32, Seed: 1})
+	b := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 32, Seed: 2})
+	differ := 0
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		if a.GetShardIndex(key) != a.GetShardIndex(key) {
+			t.Fatalf("the placement of %s is not stable", key)
+		}
+		if a.GetShardIndex(key) != b.GetShardIndex(key) {
+			differ++
+		}
+		a.Set(key, i)
+	}
+	if differ < 50 {
+		t.Fatalf("only %d of 100 keys are placed differently under another seed", differ)
+	}
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		if v, ok := a.Get(key); !ok || v != i {
+			t.Fatalf("Get(%s) = %v, %v on a seeded map", key, v, ok)
+		}
+		if items, _ := a.ShardItems(a.GetShardIndex(key)); items[key] != i {
+			t.Fatalf("%s is not stored in the shard GetShardIndex reports", key)
+		}
+	}
+}
+
+func TestReserve(t *testing.T) {
+	keys := make([]string, 20000)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	var value interface{} = 1
+	load := func(reserve bool) uint64 {
+		m := NewConcurrentMapString(4)
+		m.Set("old", 0)
+		if reserve {
+			m.Reserve(len(keys))
+			if v, ok := m.Get("old"); !ok || v != 0 {
+				t.Fatalf("Get(old) = %v, %v after Reserve", v, ok)
+			}
+		}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		for _, key := range keys {
+			m.Set(key, value)
+		}
+		runtime.ReadMemStats(&after)
+		if m.Count() != len(keys)+1 {
+			t.Fatalf("Count() = %d after the load", m.Count())
+		}
+		return after.Mallocs - before.Mallocs
+	}
+	if plain, reserved := load(false), load(true); reserved >= plain {
+		t.Fatalf("the load after Reserve made %d allocations, %d without", reserved, plain)
+	}
+}
+
+func TestLazyShardMaps(t *testing.T) {
+	const shards = 1 << 16
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	m := NewConcurrentMapString(shards)
+	runtime.ReadMemStats(&after)
+	//one allocation per shard is its lock, a map each would double it
+	if mallocs := after.Mallocs - before.Mallocs; mallocs > shards+64 {
+		t.Fatalf("the constructor made %d allocations for %d shards", mallocs, shards)
+	}
+	for i, shard := range m.shards() {
+		if shard.items != nil {
+			t.Fatalf("shard %d got its map before any write", i)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				m.Set(strconv.Itoa(i), i) //the same keys from every goroutine
+				m.Get(strconv.Itoa(w * i))
+			}
+		}(w)
+	}
+	wg.Wait()
+	used := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		if v, ok := m.Get(key); !ok || v != i {
+			t.Fatalf("Get(%s) = %v, %v", key, v, ok)
+		}
+		used[m.GetShardIndex(key)] = true
+	}
+	for i, shard := range m.shards() {
+		if (shard.items != nil) != used[i] {
+			t.Fatalf("shard %d has a map: %v, was written: %v", i, shard.items != nil, used[i])
+		}
+	}
+	if m.Count() != 100 {
+		t.Fatalf("Count() = %d, want 100", m.Count())
+	}
+}
+
+func TestMaxIterGoroutines(t *testing.T) {
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 64, MaxIterGoroutines: 4})
+	for i := 0; i < 1000; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	const iterators = 8
+	base := runtime.NumGoroutine()
+	started := sync.WaitGroup{}
+	started.Add(iterators)
+	resume := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < iterators; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			//Iter always fans out, IterBuffered iterates a map this small serially
+			ch := m.Iter()
+			<-ch
+			started.Done()
+			//a slow reader: the fan-out waits on it
+			<-resume
+			n := 1
+			for range ch {
+				n++
+			}
+			if n != 1000 {
+				t.Errorf("Iter yielded %d entries, want 1000", n)
+			}
+		}()
+	}
+	started.Wait()
+	//the iterators, a fan-in goroutine each and the slots
+	n, bound := runtime.NumGoroutine(), base+2*iterators+4
+	close(resume)
+	wg.Wait()
+	if n > bound {
+		t.Fatalf("%d goroutines were alive, want at most %d", n, bound)
+	}
+}
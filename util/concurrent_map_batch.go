@@ -0,0 +1,64 @@
+package util
+
+// Buffers writes per shard and applies each buffer under a single lock of its
+// shard, which amortizes the locking of large loads. A buffer is flushed
+// automatically once it holds flushSize entries. Not safe for concurrent use,
+// give every loading goroutine its own BatchWriter.
+type BatchWriter struct {
+	m         *ConcurrentMapString
+	flushSize int
+	buffers   map[int]map[string]interface{}
+}
+
+// Creates a BatchWriter on m, flushSize <= 0 disables the automatic flush.
+func (m *ConcurrentMapString) NewBatchWriter(flushSize int) *BatchWriter {
+	return &BatchWriter{
+		m:         m,
+		flushSize: flushSize,
+		buffers:   make(map[int]map[string]interface{}),
+	}
+}
+
+// Buffers the given value under the specified key. It is not visible in the
+// map before the buffer of its shard is flushed.
+func (w *BatchWriter) Add(key string, value interface{}) {
+	key = w.m.normalize(key)
+	idx := w.m.GetShardIndex(key)
+	buffer, ok := w.buffers[idx]
+	if !ok {
+		buffer = make(map[string]interface{})
+		w.buffers[idx] = buffer
+	}
+	buffer[key] = value
+	if w.flushSize > 0 && len(buffer) >= w.flushSize {
+		w.flush(idx)
+	}
+}
+
+// Applies all the buffered writes.
+func (w *BatchWriter) Flush() {
+	for idx := range w.buffers {
+		w.flush(idx)
+	}
+}
+
+func (w *BatchWriter) flush(idx int) {
+	buffer := w.buffers[idx]
+	delete(w.buffers, idx)
+	keys := make([]string, 0, len(buffer))
+	for key := range buffer {
+		keys = append(keys, key)
+	}
+	var inserted []string
+	room := w.m.room()
+	w.m.withShardsOf(keys, true, func(shard *concurrentMapSharedString, keys []string) {
+		for _, key := range keys {
+			if isNew, _ := w.m.store(shard, key, buffer[key], &room); isNew {
+				inserted = append(inserted, key)
+			}
+		}
+	})
+	for _, key := range inserted {
+		w.m.afterInsert(key)
+	}
+}
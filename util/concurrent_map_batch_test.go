@@ -0,0 +1,61 @@
+package util
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestBatchWriter(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	w := m.NewBatchWriter(10)
+	want := make(map[string]interface{})
+	for i := 0; i < 100; i++ {
+		w.Add(strconv.Itoa(i), i)
+		want[strconv.Itoa(i)] = i
+	}
+	if m.Count() == 0 || m.Count() == 100 {
+		t.Fatalf("Count() = %d before Flush, want the automatically flushed buffers only", m.Count())
+	}
+	w.Flush()
+	checkContents(t, m, want)
+}
+
+func benchmarkBulkLoad(b *testing.B, load func(m *ConcurrentMapString, keys []string)) {
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		load(NewConcurrentMapString(32), keys)
+	}
+}
+
+func BenchmarkBulkLoadBatchWriter(b *testing.B) {
+	benchmarkBulkLoad(b, func(m *ConcurrentMapString, keys []string) {
+		w := m.NewBatchWriter(256)
+		for i, key := range keys {
+			w.Add(key, i)
+		}
+		w.Flush()
+	})
+}
+
+func BenchmarkBulkLoadMSet(b *testing.B) {
+	benchmarkBulkLoad(b, func(m *ConcurrentMapString, keys []string) {
+		data := make(map[string]interface{}, len(keys))
+		for i, key := range keys {
+			data[key] = i
+		}
+		m.MSet(data)
+	})
+}
+
+func BenchmarkBulkLoadSet(b *testing.B) {
+	benchmarkBulkLoad(b, func(m *ConcurrentMapString, keys []string) {
+		for i, key := range keys {
+			m.Set(key, i)
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"sync/atomic"
+)
+
+// Retrieves an element from map under the key given as bytes. With the default
+// Hasher and no KeyNormalizer the bytes are hashed directly and only converted
+// to string inside the map index expressions and key comparisons, which the
+// compiler does without allocating; the other configurations fall back to
+// Get(string(key)).
+func (m *ConcurrentMapString) GetBytes(key []byte) (interface{}, bool) {
+	tables, base := m.layout()
+	if !m.rawKeys || m.opts.Loader != nil || atomic.LoadInt32(&m.pinCount) > 0 {
+		return m.Get(string(key))
+	}
+	for {
+		shard := tables[m.locateHash(fnv32Bytes(key), tables, base)]
+		shard.RLock()
+		if shard.retired {
+			shard.RUnlock()
+			tables, base = m.layout()
+			continue
+		}
+		val, ok := shard.lookupBytes(key)
+		if deadline, ttl := shard.expires[string(key)]; ok && ttl && !m.now().Before(deadline) {
+			//let Get remove it and fire the hooks
+			shard.RUnlock()
+			return m.Get(string(key))
+		}
+		if ok && shard.freqs != nil {
+			atomic.AddUint32(shard.freqs[string(key)], 1)
+		}
+		shard.RUnlock()
+		return m.Uncompress(val), ok
+	}
+}
+
+// Sets the given value under the key given as bytes. Unlike GetBytes it has
+// to allocate the string stored as key.
+func (m *ConcurrentMapString) SetBytes(key []byte, value interface{}) {
+	m.Set(string(key), value)
+}
+
+// fnv32 over the bytes of key, without converting it to a string.
+func fnv32Bytes(key []byte) uint32 {
+	hash := uint32(2166136261)
+	const prime32 = uint32(16777619)
+	for i := 0; i < len(key); i++ {
+		hash *= prime32
+		hash ^= uint32(key[i])
+	}
+	return hash
+}
@@ -0,0 +1,71 @@
+package util
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBytesAndStringKeysInteroperate(t *testing.T) {
+	long := strings.Repeat("x", 64)
+	for _, opts := range []ConcurrentMapStringOpts{
+		{ShardCount: 4},
+		{ShardCount: 4, SmallShardSize: 8},
+		{ShardCount: 4, KeyNormalizer: strings.ToLower},
+	} {
+		m := NewConcurrentMapStringWithOpts(opts)
+		for i := 0; i < 100; i++ {
+			key := long + strconv.Itoa(i)
+			if i%2 == 0 {
+				m.Set(key, i)
+			} else {
+				m.SetBytes([]byte(key), i)
+			}
+		}
+		for i := 0; i < 100; i++ {
+			key := long + strconv.Itoa(i)
+			if v, ok := m.GetBytes([]byte(key)); !ok || v != i {
+				t.Fatalf("GetBytes(%q) = %v, %v, want %d", key, v, ok, i)
+			}
+			if v, ok := m.Get(key); !ok || v != i {
+				t.Fatalf("Get(%q) = %v, %v, want %d", key, v, ok, i)
+			}
+		}
+		if _, ok := m.GetBytes([]byte("missing")); ok {
+			t.Fatal("GetBytes found a missing key")
+		}
+	}
+}
+
+func TestGetBytesDoesNotAllocate(t *testing.T) {
+	for _, size := range []int{0, 8} {
+		m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, SmallShardSize: size})
+		key := []byte(strings.Repeat("k", 64))
+		m.SetBytes(key, 1)
+		if n := testing.AllocsPerRun(100, func() { m.GetBytes(key) }); n != 0 {
+			t.Fatalf("SmallShardSize %d: GetBytes allocates %v times per call", size, n)
+		}
+	}
+}
+
+func benchmarkByteKeys(b *testing.B, get func(m *ConcurrentMapString, key []byte)) {
+	m := NewConcurrentMapString(32)
+	keys := make([][]byte, 64)
+	for i := range keys {
+		keys[i] = []byte(strings.Repeat("k", 40) + strconv.Itoa(i))
+		m.SetBytes(keys[i], i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		get(m, keys[i%len(keys)])
+	}
+}
+
+func BenchmarkGetBytes(b *testing.B) {
+	benchmarkByteKeys(b, func(m *ConcurrentMapString, key []byte) { m.GetBytes(key) })
+}
+
+func BenchmarkGetStringOfBytes(b *testing.B) {
+	benchmarkByteKeys(b, func(m *ConcurrentMapString, key []byte) { m.Get(string(key)) })
+}
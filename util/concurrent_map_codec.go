@@ -0,0 +1,214 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+const jsonDecodeBatch = 1000 //DecodeJSON每积累这么多条才MSet一次
+
+// Serializes the contents with encoding/gob, which unlike JSON keeps the concrete
+// types of the values. Callers MUST gob.Register the concrete value types.
+func (m *ConcurrentMapString) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(m.Items()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Reverse process of GobEncode, the decoded entries are added to the map.
+func (m *ConcurrentMapString) GobDecode(b []byte) error {
+	tmp := make(map[string]interface{})
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&tmp); err != nil {
+		return err
+	}
+	m.MSet(tmp)
+	return nil
+}
+
+// Streams the contents to w as a JSON object, one entry at a time instead of
+// building a temporary map like MarshalJSON does.
+func (m *ConcurrentMapString) EncodeJSON(w io.Writer) error {
+	return m.encodeJSON(w, nil)
+}
+
+// Marshals the map like MarshalJSON, but omits the entries whose value is nil
+// or the zero value of its type according to reflect.Value.IsZero: 0, false,
+// "", nil slices, maps and pointers, and structs whose fields are all zero.
+// Empty but non-nil slices and maps are kept.
+func (m *ConcurrentMapString) MarshalJSONCompact() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := m.encodeJSON(&buf, isZeroValue); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func isZeroValue(v interface{}) bool {
+	return v == nil || reflect.ValueOf(v).IsZero()
+}
+
+// Streams the entries whose value is not omitted by omit (if not nil) to w as a JSON object.
+func (m *ConcurrentMapString) encodeJSON(w io.Writer, omit func(v interface{}) bool) error {
+	if _, err := io.WriteString(w, "{"); err != nil {
+		return err
+	}
+	first := true
+	for item := range m.IterBuffered() {
+		if omit != nil && omit(item.Val) {
+			continue
+		}
+		key, err := json.Marshal(item.Key)
+		if err != nil {
+			return err
+		}
+		val, err := json.Marshal(item.Val)
+		if err != nil {
+			return err
+		}
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+		if _, err := w.Write(key); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, ":"); err != nil {
+			return err
+		}
+		if _, err := w.Write(val); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "}")
+	return err
+}
+
+// Reads a JSON object written by EncodeJSON from r and adds its entries to the map.
+// Values are decoded the way encoding/json decodes into interface{}.
+func (m *ConcurrentMapString) DecodeJSON(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return errors.New("json object expected")
+	}
+	batch := make(map[string]interface{}, jsonDecodeBatch)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return errors.New("json object key expected")
+		}
+		var val interface{}
+		if err := dec.Decode(&val); err != nil {
+			return err
+		}
+		batch[key] = val
+		if len(batch) >= jsonDecodeBatch {
+			m.MSet(batch)
+			batch = make(map[string]interface{}, jsonDecodeBatch)
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	m.MSet(batch)
+	return nil
+}
+
+// Persists the map to path as JSON. The data is written to a temporary file
+// which is renamed to path at last, so path never holds a partial file.
+func (m *ConcurrentMapString) SaveToFile(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //rename成功后这里删除会失败，无需处理
+	w := bufio.NewWriter(tmp)
+	if err = m.EncodeJSON(w); err == nil {
+		if err = w.Flush(); err == nil {
+			err = tmp.Sync()
+		}
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Restores the entries persisted by SaveToFile into the map.
+func (m *ConcurrentMapString) LoadFromFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return m.DecodeJSON(bufio.NewReader(f))
+}
+
+// Streams newline delimited records from r into the map with bounded memory.
+// parse turns one line into an entry, blank lines are skipped. The first
+// malformed line stops the load with an error carrying its line number, the
+// entries of the preceding lines stay in the map.
+func (m *ConcurrentMapString) LoadJSONL(r io.Reader, parse func(line []byte) (key string, value interface{}, err error)) error {
+	reader := bufio.NewReader(r)
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			key, value, parseErr := parse(trimmed)
+			if parseErr != nil {
+				return fmt.Errorf("line %d: %w", lineNo, parseErr)
+			}
+			if setErr := m.SetChecked(key, value); setErr != nil {
+				return fmt.Errorf("line %d: %w", lineNo, setErr)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// Returns an order independent hash of the contents: the XOR of the 64-bit
+// FNV-1a hashes of every key followed by a zero byte and its value encoded with
+// encoding/json (fmt's %#v for values JSON cannot encode). Maps with the same
+// contents yield the same checksum regardless of shard layout, e.g. to verify
+// replicas. As JSON sorts map keys, map values hash deterministically too.
+func (m *ConcurrentMapString) Checksum() uint64 {
+	var sum uint64
+	m.IterCb(func(key string, v interface{}) {
+		h := fnv.New64a()
+		io.WriteString(h, key)
+		h.Write([]byte{0})
+		if b, err := json.Marshal(v); err == nil {
+			h.Write(b)
+		} else {
+			fmt.Fprintf(h, "%#v", v)
+		}
+		sum ^= h.Sum64()
+	})
+	return sum
+}
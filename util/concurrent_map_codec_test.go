@@ -0,0 +1,139 @@
+package util
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLoadJSONL(t *testing.T) {
+	errBad := errors.New("bad line")
+	parse := func(line []byte) (string, interface{}, error) {
+		parts := strings.SplitN(string(line), "=", 2)
+		if len(parts) != 2 {
+			return "", nil, errBad
+		}
+		return parts[0], parts[1], nil
+	}
+	m := NewConcurrentMapString(4)
+	err := m.LoadJSONL(strings.NewReader("a=1\n\n  b=2  \nbroken\nc=3\n"), parse)
+	if !errors.Is(err, errBad) || !strings.HasPrefix(err.Error(), "line 4: ") {
+		t.Fatalf("LoadJSONL error = %v, want the parse error of line 4", err)
+	}
+	checkContents(t, m, map[string]interface{}{"a": "1", "b": "2"})
+
+	if err := m.LoadJSONL(strings.NewReader("c=3"), parse); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m.Get("c"); v != "3" {
+		t.Fatalf("Get(c) = %v, the last line without a newline was not loaded", v)
+	}
+}
+
+type gobPoint struct {
+	X, Y int
+}
+
+func TestGobRoundTrip(t *testing.T) {
+	gob.Register(gobPoint{})
+	m := NewConcurrentMapString(4)
+	m.Set("p", gobPoint{1, 2})
+	m.Set("s", "text")
+	data, err := m.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewConcurrentMapString(2)
+	if err := restored.GobDecode(data); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, restored, map[string]interface{}{"p": gobPoint{1, 2}, "s": "text"})
+}
+
+func TestSaveToFileAndLoadFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "concurrent_map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "map.json")
+
+	m := NewConcurrentMapString(4)
+	want := make(map[string]interface{})
+	for i := 0; i < 100; i++ {
+		//JSON numbers decode as float64
+		m.Set(strconv.Itoa(i), float64(i))
+		want[strconv.Itoa(i)] = float64(i)
+	}
+	if err := m.SaveToFile(path); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewConcurrentMapString(8)
+	if err := restored.LoadFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, restored, want)
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("SaveToFile left %d files behind", len(files))
+	}
+}
+
+func TestMarshalJSONCompact(t *testing.T) {
+	type point struct{ X, Y int }
+	m := NewConcurrentMapString(4)
+	m.MSet(map[string]interface{}{
+		"zero": 0, "false": false, "empty": "", "nil": nil, "nilSlice": []int(nil), "zeroStruct": point{},
+		"one": 1, "true": true, "text": "x", "emptySlice": []int{}, "point": point{1, 2},
+	})
+	data, err := m.MarshalJSONCompact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"one": 1.0, "true": true, "text": "x", "emptySlice": []interface{}{}, "point": map[string]interface{}{"X": 1.0, "Y": 2.0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("MarshalJSONCompact() = %s", data)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	fill := func(m *ConcurrentMapString) *ConcurrentMapString {
+		for i := 0; i < 200; i++ {
+			m.Set(strconv.Itoa(i), map[string]int{"a": i, "b": -i})
+		}
+		return m
+	}
+	a := fill(NewConcurrentMapString(4))
+	b := fill(NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 32, SmallShardSize: 8}))
+	if a.Checksum() != b.Checksum() {
+		t.Fatal("the same contents in different layouts have different checksums")
+	}
+	sum := a.Checksum()
+	a.Set("7", map[string]int{"a": 7, "b": 7})
+	if a.Checksum() == sum {
+		t.Fatal("changing a value kept the checksum")
+	}
+	a.Set("7", map[string]int{"a": 7, "b": -7})
+	if a.Checksum() != sum {
+		t.Fatal("restoring the value did not restore the checksum")
+	}
+	a.Remove("7")
+	if a.Checksum() == sum {
+		t.Fatal("removing a key kept the checksum")
+	}
+	if NewConcurrentMapString(4).Checksum() != 0 {
+		t.Fatal("the checksum of an empty map is not 0")
+	}
+}
@@ -0,0 +1,115 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"reflect"
+)
+
+// Compresses the large string and []byte values, see CompressThreshold.
+type ValueCodec interface {
+	Encode(data []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+// ValueCodec using compress/gzip at Level, 0 means gzip.DefaultCompression.
+type GzipCodec struct {
+	Level int
+}
+
+func (c GzipCodec) Encode(data []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c GzipCodec) Decode(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// A string or []byte value stored compressed. Every method returning values,
+// passing them to callbacks or encoding them sees the original value; only the
+// low level accesses to the stored items (WithShard, ShardHandle, AddIndex)
+// see the *CompressedValue, which Uncompress turns back into it.
+type CompressedValue struct {
+	Data     []byte
+	IsString bool
+}
+
+var (
+	stringType = reflect.TypeOf("")
+	bytesType  = reflect.TypeOf([]byte(nil))
+)
+
+// Returns the type of the original value, which TypeGuard compares.
+func valueType(v interface{}) reflect.Type {
+	if cv, ok := v.(*CompressedValue); ok {
+		if cv.IsString {
+			return stringType
+		}
+		return bytesType
+	}
+	return reflect.TypeOf(v)
+}
+
+// Returns v compressed if it is a string or []byte longer than
+// CompressThreshold, v itself otherwise or if the codec fails.
+func (m *ConcurrentMapString) compress(v interface{}) interface{} {
+	if m.opts.CompressThreshold <= 0 {
+		return v
+	}
+	var data []byte
+	isString := false
+	switch value := v.(type) {
+	case string:
+		data, isString = []byte(value), true
+	case []byte:
+		data = value
+	default:
+		return v
+	}
+	if len(data) <= m.opts.CompressThreshold {
+		return v
+	}
+	encoded, err := m.opts.ValueCodec.Encode(data)
+	if err != nil {
+		return v
+	}
+	return &CompressedValue{Data: encoded, IsString: isString}
+}
+
+// Returns the original value of a *CompressedValue, any other v as is. If the
+// codec fails, v is returned as is as well.
+func (m *ConcurrentMapString) Uncompress(v interface{}) interface{} {
+	cv, ok := v.(*CompressedValue)
+	if !ok || m.opts.ValueCodec == nil {
+		return v
+	}
+	data, err := m.opts.ValueCodec.Decode(cv.Data)
+	if err != nil {
+		return v
+	}
+	if cv.IsString {
+		return string(data)
+	}
+	return data
+}
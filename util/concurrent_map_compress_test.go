@@ -0,0 +1,47 @@
+package util
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// A GzipCodec counting the Decode calls.
+type countingCodec struct {
+	GzipCodec
+	decodes int64
+}
+
+func (c *countingCodec) Decode(data []byte) ([]byte, error) {
+	atomic.AddInt64(&c.decodes, 1)
+	return c.GzipCodec.Decode(data)
+}
+
+func TestKeysDoNotDecompress(t *testing.T) {
+	for _, ordered := range []bool{false, true} {
+		codec := &countingCodec{}
+		m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, Ordered: ordered, CompressThreshold: 16, ValueCodec: codec})
+		long := strings.Repeat("v", 100)
+		for i := 0; i < 100; i++ {
+			m.Set(strconv.Itoa(i), long)
+		}
+		if keys := m.Keys(); len(keys) != 100 {
+			t.Fatalf("Keys() has %d entries, want 100", len(keys))
+		}
+		n := 0
+		m.KeysCb(func(key string) bool {
+			n++
+			return true
+		})
+		if n != 100 {
+			t.Fatalf("KeysCb visited %d keys, want 100", n)
+		}
+		if codec.decodes != 0 {
+			t.Fatalf("Ordered %v: %d values decompressed", ordered, codec.decodes)
+		}
+		if v, _ := m.Get("1"); v != long || codec.decodes != 1 {
+			t.Fatalf("Get(1) = %v after %d decodes", v, codec.decodes)
+		}
+	}
+}
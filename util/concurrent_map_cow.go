@@ -0,0 +1,133 @@
+package util
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// A copy-on-write variant of ConcurrentMapString for read-mostly data: Get
+// takes no lock at all, while every write copies the map of its shard.
+//
+// Readers load the current map of a shard from an atomic.Value and never see
+// it change. Writers serialize on a per-shard mutex, copy the map, modify the
+// copy and publish it with a single atomic store. In languages without a GC
+// this needs epoch based reclamation, so that a replaced map is not freed
+// while a reader still uses it; here the garbage collector frees it once the
+// last reader drops its reference, which is exactly that guarantee.
+// ConcurrentMapStringEpoch tracks the readers with epochs nonetheless, so that
+// writers can reuse the replaced maps instead of allocating one per write.
+type ConcurrentMapStringCOW struct {
+	shards []*cowShard
+}
+
+type cowShard struct {
+	items atomic.Value // map[string]interface{}, never modified once stored
+	lock  sync.Mutex   // serializes the writers
+}
+
+var _ ConcurrentMap = (*ConcurrentMapStringCOW)(nil)
+
+// Creates a new copy-on-write concurrent map.
+func NewConcurrentMapStringCOW(shardCount int) *ConcurrentMapStringCOW {
+	if shardCount <= 0 {
+		shardCount = DEFAULT_SHARD_COUNT
+	}
+	m := &ConcurrentMapStringCOW{shards: make([]*cowShard, shardCount)}
+	for i := range m.shards {
+		m.shards[i] = &cowShard{}
+		m.shards[i].items.Store(map[string]interface{}{})
+	}
+	return m
+}
+
+func (m *ConcurrentMapStringCOW) shardOf(key string) *cowShard {
+	return m.shards[uint(fnv32(key))%uint(len(m.shards))]
+}
+
+func (shard *cowShard) load() map[string]interface{} {
+	return shard.items.Load().(map[string]interface{})
+}
+
+// Copies the map of the shard, lets fn modify the copy and publishes it.
+func (shard *cowShard) update(fn func(items map[string]interface{})) {
+	shard.lock.Lock()
+	old := shard.load()
+	items := make(map[string]interface{}, len(old)+1)
+	for key, val := range old {
+		items[key] = val
+	}
+	fn(items)
+	shard.items.Store(items)
+	shard.lock.Unlock()
+}
+
+// Sets the given value under the specified key, copying the map of its shard.
+func (m *ConcurrentMapStringCOW) Set(key string, value interface{}) {
+	m.shardOf(key).update(func(items map[string]interface{}) {
+		items[key] = value
+	})
+}
+
+// Sets the given value under the specified key and returns it, i.e. the state
+// this write produced. Within one goroutine a Get after Set already sees the
+// write: atomic.Value's Store and Load are synchronizing operations under the
+// Go memory model, whatever the architecture. But another writer may replace
+// the value right after, so a following Get may return that one instead;
+// SetAndGet returns the written value directly and is never affected by it.
+func (m *ConcurrentMapStringCOW) SetAndGet(key string, value interface{}) interface{} {
+	m.Set(key, value)
+	return value
+}
+
+// Retrieves an element from map under given key, without locking.
+func (m *ConcurrentMapStringCOW) Get(key string) (interface{}, bool) {
+	val, ok := m.shardOf(key).load()[key]
+	return val, ok
+}
+
+// Looks up an item under specified key, without locking.
+func (m *ConcurrentMapStringCOW) Has(key string) bool {
+	_, ok := m.shardOf(key).load()[key]
+	return ok
+}
+
+// Removes an element from the map.
+func (m *ConcurrentMapStringCOW) Remove(key string) {
+	shard := m.shardOf(key)
+	if _, ok := shard.load()[key]; !ok {
+		return
+	}
+	shard.update(func(items map[string]interface{}) {
+		delete(items, key)
+	})
+}
+
+// Returns the number of elements within the map.
+func (m *ConcurrentMapStringCOW) Count() int {
+	count := 0
+	for _, shard := range m.shards {
+		count += len(shard.load())
+	}
+	return count
+}
+
+// Returns all keys as []string.
+func (m *ConcurrentMapStringCOW) Keys() []string {
+	keys := make([]string, 0, m.Count())
+	for _, shard := range m.shards {
+		for key := range shard.load() {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Callback based iterator over the current snapshot of every shard. fn may
+// access the map, writes are not seen by the ongoing iteration of their shard.
+func (m *ConcurrentMapStringCOW) IterCb(fn IterCb) {
+	for _, shard := range m.shards {
+		for key, val := range shard.load() {
+			fn(key, val)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package util
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestCOWSetAndGet(t *testing.T) {
+	m := NewConcurrentMapStringCOW(4)
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := strconv.Itoa(i % 5) //shared with the other writers
+				if v := m.SetAndGet(key, g*1000+i); v != g*1000+i {
+					t.Errorf("SetAndGet(%s, %d) = %v", key, g*1000+i, v)
+				}
+				own := "own" + strconv.Itoa(g)
+				m.Set(own, i)
+				if v, ok := m.Get(own); !ok || v != i {
+					t.Errorf("Get(%s) = %v, %v right after setting %d", own, v, ok, i)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if m.Count() != 13 {
+		t.Fatalf("Count() = %d, want 13", m.Count())
+	}
+}
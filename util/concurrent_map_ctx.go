@@ -0,0 +1,158 @@
+package util
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Folds fn over the entries of the map starting from initial, e.g. to aggregate
+// a huge map. Shards are copied and folded one at a time, so the memory needed
+// is bounded by the largest shard rather than the whole map, and no lock is
+// held while fn runs. Gives up with the accumulator so far and ctx.Err() once
+// ctx is done.
+func (m *ConcurrentMapString) StreamReduce(ctx context.Context, initial interface{}, fn func(acc interface{}, t TupleString) interface{}) (interface{}, error) {
+	acc := initial
+	var tuples []TupleString
+	for _, shard := range m.shards() {
+		if err := ctx.Err(); err != nil {
+			return acc, err
+		}
+		tuples = tuples[:0]
+		shard.RLock()
+		shard.each(func(key string, val interface{}) bool {
+			tuples = append(tuples, TupleString{key, val})
+			return true
+		})
+		shard.RUnlock()
+		for _, t := range tuples {
+			if err := ctx.Err(); err != nil {
+				return acc, err
+			}
+			t.Val = m.Uncompress(t.Val)
+			acc = fn(acc, t)
+		}
+	}
+	return acc, nil
+}
+
+// Sets the given value under the specified key, giving up with ctx.Err() if ctx
+// is done before the shard lock could be acquired.
+func (m *ConcurrentMapString) SetCtx(ctx context.Context, key string, value interface{}) error {
+	m.checkNil()
+	if m.opts.TrackMetrics {
+		atomic.AddInt64(&m.ops.sets, 1)
+	}
+	if err := m.checkSize(key, value); err != nil {
+		return err
+	}
+	value = m.compress(value)
+	key = m.normalize(key)
+	room := m.room()
+	shard, err := m.lockShardCtx(ctx, key, true)
+	if err != nil {
+		return err
+	}
+	inserted, err := m.store(shard, key, value, &room)
+	shard.Unlock()
+	if inserted {
+		m.afterInsert(key)
+	}
+	return err
+}
+
+// Retrieves an element from map under given key, giving up with ctx.Err() if
+// ctx is done before the shard lock could be acquired.
+// Expired entries are reported as absent but left for the janitor.
+func (m *ConcurrentMapString) GetCtx(ctx context.Context, key string) (interface{}, bool, error) {
+	key = m.normalize(key)
+	shard, err := m.lockShardCtx(ctx, key, false)
+	if err != nil {
+		return nil, false, err
+	}
+	defer shard.RUnlock()
+	val, ok := shard.lookup(key)
+	if !ok || shard.expired(key, m.now()) {
+		return nil, false, nil
+	}
+	if shard.freqs != nil {
+		atomic.AddUint32(shard.freqs[key], 1)
+	}
+	return m.Uncompress(val), true, nil
+}
+
+// Sets the tuples received from in using workers goroutines, until in is
+// closed and drained or ctx is done, in which case ctx.Err() is returned and
+// the tuples not received yet are left in in. A slow map slows down the
+// producer through in rather than buffering without bound.
+func (m *ConcurrentMapString) ConsumeFrom(ctx context.Context, in <-chan TupleString, workers int) error {
+	if workers <= 0 {
+		workers = 1
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case t, ok := <-in:
+					if !ok {
+						return
+					}
+					m.Set(t.Key, t.Val)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// Longest sleep between two attempts of lockShardCtx.
+const ctxPollMax = time.Millisecond
+
+// Returns the shard under key with its write (or read) lock held, or ctx.Err()
+// if ctx is done first. The lock is polled with TryLock, yielding at first and
+// then sleeping ever longer up to ctxPollMax between the attempts, so that
+// nothing is left behind holding or waiting for the lock once ctx is done. A
+// polling caller may lose to the ones blocking in Lock under contention.
+func (m *ConcurrentMapString) lockShardCtx(ctx context.Context, key string, write bool) (*concurrentMapSharedString, error) {
+	backoff := time.Microsecond
+	for i := 1; ; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		shard := m.shardOf(key)
+		if write && shard.TryLock() {
+			if !shard.retired {
+				return shard, nil
+			}
+			shard.Unlock()
+			continue
+		}
+		if !write && shard.TryRLock() {
+			if !shard.retired {
+				return shard, nil
+			}
+			shard.RUnlock()
+			continue
+		}
+		if i < spinsBeforeYield {
+			runtime.Gosched()
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff < ctxPollMax {
+			backoff *= 2
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCtxGivesUpOnHeldLock(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	m.Set("a", 1)
+	shard := m.lockShard("a")
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		if err := m.SetCtx(ctx, "a", 2); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("SetCtx on a held lock = %v", err)
+		}
+		if _, _, err := m.GetCtx(ctx, "a"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("GetCtx on a held lock = %v", err)
+		}
+		cancel()
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("%d goroutines left behind", after-before)
+	}
+	shard.Unlock()
+
+	if err := m.SetCtx(context.Background(), "a", 3); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := m.GetCtx(context.Background(), "a"); v != 3 || !ok || err != nil {
+		t.Fatalf("GetCtx(a) = %v, %v, %v", v, ok, err)
+	}
+}
+
+func TestCtxWaitsForReleasedLock(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	shard := m.lockShard("a")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		shard.Unlock()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := m.SetCtx(ctx, "a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m.Get("a"); v != 1 {
+		t.Fatalf("Get(a) = %v", v)
+	}
+}
+
+func TestConsumeFrom(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	in := make(chan TupleString)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			in <- TupleString{strconv.Itoa(i), i}
+		}
+		close(in)
+	}()
+	if err := m.ConsumeFrom(context.Background(), in, 4); err != nil {
+		t.Fatal(err)
+	}
+	if m.Count() != 1000 {
+		t.Fatalf("Count() = %d after consuming 1000 tuples", m.Count())
+	}
+
+	//cancelled with the channel still open and idle
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- m.ConsumeFrom(ctx, make(chan TupleString), 2)
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("ConsumeFrom() = %v after cancel", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ConsumeFrom did not return after cancel")
+	}
+}
+
+func TestStreamReduce(t *testing.T) {
+	m := NewConcurrentMapString(8)
+	for i := 1; i <= 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	sum := func(acc interface{}, t TupleString) interface{} {
+		return acc.(int) + t.Val.(int)
+	}
+	if got, err := m.StreamReduce(context.Background(), 0, sum); err != nil || got != 5050 {
+		t.Fatalf("StreamReduce() = %v, %v, want 5050", got, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	folded := 0
+	got, err := m.StreamReduce(ctx, 0, func(acc interface{}, t TupleString) interface{} {
+		if folded++; folded == 10 {
+			cancel()
+		}
+		return sum(acc, t)
+	})
+	if err != context.Canceled || folded != 10 {
+		t.Fatalf("StreamReduce() = %v after folding %d entries, want it to stop at the cancel", err, folded)
+	}
+	if got.(int) <= 0 || got.(int) >= 5050 {
+		t.Fatalf("StreamReduce() = %v on cancel, want the partial sum", got)
+	}
+}
@@ -0,0 +1,114 @@
+package util
+
+// Number of values a Cursor reads per shard lock.
+const cursorBatch = 64
+
+// Live iterator over a ConcurrentMapString, see NewCursor.
+type Cursor struct {
+	m      *ConcurrentMapString
+	tables []*concurrentMapSharedString
+	base   int
+	shard  int      // index of the shard being walked
+	keys   []string // keys of the shard not read yet
+	batch  []TupleString
+	walked []cursorLayout // layouts swapped out while walking them
+}
+
+// A layout the cursor walked up to and including the shard at index done.
+type cursorLayout struct {
+	tables []*concurrentMapSharedString
+	base   int
+	done   int
+}
+
+// Returns a cursor walking the map shard by shard. Unlike IterBuffered nothing
+// is snapshotted up front: the keys of a shard are collected when the cursor
+// reaches it and their values are read in small batches, each under a brief
+// read lock. Entries removed before the cursor reads them are skipped, entries
+// added to already collected shards are missed. The map may change between
+// two batches, so the entries returned are not a consistent view.
+// Once Resize, ReplaceAll or a hot shard split swaps in new shards the cursor
+// reads the keys it collected from their new owners and walks the new shards,
+// skipping the keys the shards already walked owned.
+func (m *ConcurrentMapString) NewCursor() *Cursor {
+	tables, base := m.layout()
+	return &Cursor{m: m, tables: tables, base: base, shard: -1}
+}
+
+// Returns the next entry, ok is false once the cursor is exhausted.
+func (c *Cursor) Next() (t TupleString, ok bool) {
+	for len(c.batch) == 0 {
+		c.resolve()
+		if len(c.keys) == 0 {
+			c.shard++
+			if c.shard >= len(c.tables) {
+				return t, false
+			}
+			c.collectKeys()
+			continue
+		}
+		c.readBatch()
+	}
+	t = c.batch[0]
+	c.batch = c.batch[1:]
+	return t, true
+}
+
+// Switches to the current layout if the one walked was swapped out.
+func (c *Cursor) resolve() {
+	tables, base := c.m.layout()
+	if len(tables) == len(c.tables) && &tables[0] == &c.tables[0] {
+		return
+	}
+	for _, key := range c.keys {
+		shard := c.m.rlockShard(key)
+		if val, ok := shard.lookup(key); ok {
+			c.batch = append(c.batch, TupleString{key, c.m.Uncompress(val)})
+		}
+		shard.RUnlock()
+	}
+	c.keys = nil
+	if c.shard >= 0 {
+		c.walked = append(c.walked, cursorLayout{tables: c.tables, base: c.base, done: c.shard})
+	}
+	c.tables, c.base, c.shard = tables, base, -1
+}
+
+// Reports whether key belonged to a shard walked in a swapped out layout.
+func (c *Cursor) seen(key string) bool {
+	for _, l := range c.walked {
+		if c.m.locate(key, l.tables, l.base) <= l.done {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cursor) collectKeys() {
+	shard := c.tables[c.shard]
+	shard.RLock()
+	c.keys = make([]string, 0, shard.size())
+	shard.each(func(key string, _ interface{}) bool {
+		if !c.seen(key) {
+			c.keys = append(c.keys, key)
+		}
+		return true
+	})
+	shard.RUnlock()
+}
+
+func (c *Cursor) readBatch() {
+	n := len(c.keys)
+	if n > cursorBatch {
+		n = cursorBatch
+	}
+	shard := c.tables[c.shard]
+	shard.RLock()
+	for _, key := range c.keys[:n] {
+		if val, ok := shard.lookup(key); ok {
+			c.batch = append(c.batch, TupleString{key, c.m.Uncompress(val)})
+		}
+	}
+	shard.RUnlock()
+	c.keys = c.keys[n:]
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestCursorAcrossResize(t *testing.T) {
+	for _, size := range []int{0, 8} {
+		m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, SmallShardSize: size})
+		for i := 0; i < 1000; i++ {
+			m.Set(strconv.Itoa(i), i)
+		}
+		c := m.NewCursor()
+		seen := make(map[string]int)
+		next := func(n int) {
+			for ; n != 0; n-- {
+				tuple, ok := c.Next()
+				if !ok {
+					return
+				}
+				seen[tuple.Key]++
+			}
+		}
+		next(300)
+		m.Resize(7)
+		next(300)
+		m.Resize(2)
+		m.Remove("999")
+		next(-1)
+		for key, n := range seen {
+			if n != 1 {
+				t.Fatalf("key %s returned %d times", key, n)
+			}
+		}
+		for i := 0; i < 999; i++ {
+			if seen[strconv.Itoa(i)] != 1 {
+				t.Fatalf("key %d missed", i)
+			}
+		}
+	}
+}
+
+func TestCursorAfterReplaceAll(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	c := m.NewCursor()
+	c.Next()
+	//the rest of the batch was read before
+	stale := len(c.batch)
+	m.ReplaceAll(map[string]interface{}{"x": 1})
+	var got []string
+	for {
+		tuple, ok := c.Next()
+		if !ok {
+			break
+		}
+		got = append(got, tuple.Key)
+	}
+	if len(got) > stale+1 {
+		t.Fatalf("got %d entries after ReplaceAll, want at most %d", len(got), stale+1)
+	}
+	for _, key := range got[stale:] {
+		if key != "x" {
+			t.Fatalf("got %s after ReplaceAll removed it", key)
+		}
+	}
+}
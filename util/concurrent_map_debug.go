@@ -0,0 +1,42 @@
+package util
+
+// The only key of a map lent to a WithShard callback once it has returned.
+const leakSentinel = "\x00util: items map leaked by a WithShard callback"
+
+// Number of the maps lent by each shard which are watched for late writes.
+const leakWatch = 8
+
+// Makes lent, the copy of items a WithShard callback got in the DebugLeaks
+// mode, the items of the shard, then empties it but for leakSentinel so that
+// leaked notices any later write to it. The write lock MUST be held.
+func (shard *concurrentMapSharedString) takeBack(lent map[string]interface{}) {
+	items := make(map[string]interface{}, len(lent))
+	for k, v := range lent {
+		items[k] = v
+	}
+	shard.setItems(items)
+	for k := range lent {
+		delete(lent, k)
+	}
+	lent[leakSentinel] = nil
+	if len(shard.lent) == leakWatch {
+		shard.lent = append(shard.lent[:0], shard.lent[1:]...)
+	}
+	shard.lent = append(shard.lent, lent)
+}
+
+// What the DebugLeaks mode panics with once leaked reports true.
+const leakPanic = "util: the items map passed to a WithShard callback was modified after the callback returned, it MUST NOT be retained"
+
+// Reports whether a map lent to one of the last leakWatch WithShard callbacks
+// of the shard was written after the callback returned, i.e. the callback
+// leaked it. The read lock MUST be held; callers release it before panicking
+// with leakPanic, so that recovering from the panic leaves the shard usable.
+func (shard *concurrentMapSharedString) leaked() bool {
+	for _, lent := range shard.lent {
+		if _, ok := lent[leakSentinel]; !ok || len(lent) != 1 {
+			return true
+		}
+	}
+	return false
+}
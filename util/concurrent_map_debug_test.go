@@ -0,0 +1,45 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+// Returns the message fn panicked with, "" if it did not panic.
+func panicMessage(fn func()) (msg string) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg = r.(string)
+		}
+	}()
+	fn()
+	return ""
+}
+
+func TestDebugLeaks(t *testing.T) {
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 1, DebugLeaks: true})
+	m.Set("a", 1)
+	//a well behaved callback
+	m.WithShard("a", func(items map[string]interface{}) {
+		items["b"] = items["a"]
+	})
+	if msg := panicMessage(func() { m.IterCb(func(string, interface{}) {}) }); msg != "" {
+		t.Fatalf("the guard fired without a leak: %s", msg)
+	}
+	checkContents(t, m, map[string]interface{}{"a": 1, "b": 1})
+
+	var leaked map[string]interface{}
+	m.WithShard("a", func(items map[string]interface{}) {
+		leaked = items
+	})
+	leaked["c"] = 3
+	if msg := panicMessage(func() { m.IterCb(func(string, interface{}) {}) }); !strings.Contains(msg, "MUST NOT be retained") {
+		t.Fatalf("IterCb after a leaked write panicked with %q", msg)
+	}
+	if msg := panicMessage(func() { m.WithShard("a", func(map[string]interface{}) {}) }); msg == "" {
+		t.Fatal("WithShard after a leaked write did not panic")
+	}
+	if m.Has("c") {
+		t.Fatal("the write to the leaked map reached the shard")
+	}
+}
@@ -0,0 +1,57 @@
+package util
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Wakes up the WaitEmpty callers when a shard becomes empty.
+type drainSignal struct {
+	waiting int32 // WaitEmpty callers, notify is a no-op without any
+	lock    sync.Mutex
+	ch      chan struct{} // closed and replaced by notify
+}
+
+// Returns the channel the next notify closes.
+func (s *drainSignal) wait() <-chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ch == nil {
+		s.ch = make(chan struct{})
+	}
+	return s.ch
+}
+
+func (s *drainSignal) notify() {
+	if s == nil || atomic.LoadInt32(&s.waiting) == 0 {
+		return
+	}
+	s.lock.Lock()
+	if s.ch != nil {
+		close(s.ch)
+		s.ch = nil
+	}
+	s.lock.Unlock()
+}
+
+// Blocks until the map is empty, or returns ctx.Err() if ctx is done first,
+// e.g. to wait for consumers to drain it on shutdown. It does not poll: the
+// removals which empty a shard wake it up to check Count again.
+func (m *ConcurrentMapString) WaitEmpty(ctx context.Context) error {
+	m.shards()
+	atomic.AddInt32(&m.drained.waiting, 1)
+	defer atomic.AddInt32(&m.drained.waiting, -1)
+	for {
+		//take the channel before checking, so that a removal in between is not missed
+		ch := m.drained.wait()
+		if m.Count() == 0 {
+			return nil
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package util
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWaitEmpty(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	done := make(chan error)
+	go func() {
+		done <- m.WaitEmpty(context.Background())
+	}()
+	for i := 0; i < 100; i++ {
+		select {
+		case <-done:
+			t.Fatalf("WaitEmpty returned with %d entries left", m.Count())
+		default:
+		}
+		if i%2 == 0 {
+			m.Remove(strconv.Itoa(i))
+		} else {
+			m.Pop(strconv.Itoa(i))
+		}
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitEmpty did not return once the map was drained")
+	}
+
+	m.Set("left", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.WaitEmpty(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("WaitEmpty() = %v on a map never drained", err)
+	}
+}
@@ -0,0 +1,207 @@
+package util
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Number of the replaced maps a shard keeps for reuse, and of those it waits
+// to reuse. Beyond that they are left to the garbage collector.
+const (
+	maxEpochFree    = 2
+	maxEpochRetired = 8
+)
+
+// A variant of ConcurrentMapStringCOW whose writers reuse the maps they
+// replaced instead of allocating a new one per write, for read-dominated
+// workloads with steady writes. Get takes no lock either.
+//
+// A replaced map may only be cleared and refilled once no reader can still be
+// reading it, which each shard tracks with epochs: a reader registers in the
+// current epoch of the shard for the duration of its access, a writer tags the
+// map it replaced with the current epoch and advances the epoch once nobody
+// is registered in the previous one. Readers of an epoch later than the tag
+// loaded the map which replaced it, so the map is reused once the readers of
+// its epoch are gone. Writers never wait for readers: while a slow reader (e.g.
+// an IterCb callback) holds an epoch, they allocate as ConcurrentMapStringCOW
+// does, and the garbage collector still frees a map dropped by the shard only
+// once no reader references it.
+type ConcurrentMapStringEpoch struct {
+	shards []*epochShard
+}
+
+type epochShard struct {
+	epoch   uint64       // current epoch, advanced by the writers. Keep the 64-bit fields first for alignment.
+	readers [2]int64     // number of readers registered in the even and the odd epochs
+	items   atomic.Value // map[string]interface{}, not modified while published
+	lock    sync.Mutex   // serializes the writers, guards the fields below
+	retired []retiredMap // replaced maps which readers may still be reading, oldest first
+	free    []map[string]interface{}
+}
+
+// A map replaced during epoch.
+type retiredMap struct {
+	items map[string]interface{}
+	epoch uint64
+}
+
+var _ ConcurrentMap = (*ConcurrentMapStringEpoch)(nil)
+
+// Creates a new concurrent map with epoch based reuse of the replaced maps.
+func NewConcurrentMapStringEpoch(shardCount int) *ConcurrentMapStringEpoch {
+	if shardCount <= 0 {
+		shardCount = DEFAULT_SHARD_COUNT
+	}
+	m := &ConcurrentMapStringEpoch{shards: make([]*epochShard, shardCount)}
+	for i := range m.shards {
+		m.shards[i] = &epochShard{}
+		m.shards[i].items.Store(map[string]interface{}{})
+	}
+	return m
+}
+
+func (m *ConcurrentMapStringEpoch) shardOf(key string) *epochShard {
+	return m.shards[uint(fnv32(key))%uint(len(m.shards))]
+}
+
+// Registers a reader in the current epoch and returns it, pass it to exit once
+// the map loaded meanwhile is not used anymore. The epoch is checked again
+// after the registration: a writer advancing it in between may not have seen
+// the registration, so the reader retries in the new epoch.
+func (shard *epochShard) enter() uint64 {
+	for {
+		e := atomic.LoadUint64(&shard.epoch)
+		atomic.AddInt64(&shard.readers[e&1], 1)
+		if atomic.LoadUint64(&shard.epoch) == e {
+			return e
+		}
+		atomic.AddInt64(&shard.readers[e&1], -1)
+	}
+}
+
+func (shard *epochShard) exit(e uint64) {
+	atomic.AddInt64(&shard.readers[e&1], -1)
+}
+
+func (shard *epochShard) load() map[string]interface{} {
+	return shard.items.Load().(map[string]interface{})
+}
+
+// Moves the retired maps no reader can hold anymore to free and advances the
+// epoch, unless readers of the previous epoch are still registered. Those
+// share the counter with the next epoch, which therefore has to be unused
+// before it starts. The lock MUST be held.
+func (shard *epochShard) reclaim() {
+	e := atomic.LoadUint64(&shard.epoch)
+	if atomic.LoadInt64(&shard.readers[(e+1)&1]) != 0 {
+		return
+	}
+	//only the readers of e and the previous epochs may hold the maps retired
+	//before e, and those of the previous ones are gone
+	n := 0
+	for n < len(shard.retired) && shard.retired[n].epoch < e {
+		if len(shard.free) < maxEpochFree {
+			shard.free = append(shard.free, shard.retired[n].items)
+		}
+		n++
+	}
+	shard.retired = append(shard.retired[:0], shard.retired[n:]...)
+	atomic.StoreUint64(&shard.epoch, e+1)
+}
+
+// Publishes a modified copy of the map of the shard, fn modifies the copy.
+func (shard *epochShard) update(fn func(items map[string]interface{})) {
+	shard.lock.Lock()
+	shard.reclaim()
+	old := shard.load()
+	var items map[string]interface{}
+	if n := len(shard.free); n > 0 {
+		items = shard.free[n-1]
+		shard.free = shard.free[:n-1]
+		for key := range items {
+			delete(items, key)
+		}
+	} else {
+		items = make(map[string]interface{}, len(old)+1)
+	}
+	for key, val := range old {
+		items[key] = val
+	}
+	fn(items)
+	shard.items.Store(items)
+	if len(shard.retired) == maxEpochRetired {
+		//readers are lagging behind, drop the oldest one
+		shard.retired = append(shard.retired[:0], shard.retired[1:]...)
+	}
+	shard.retired = append(shard.retired, retiredMap{items: old, epoch: atomic.LoadUint64(&shard.epoch)})
+	shard.lock.Unlock()
+}
+
+// Sets the given value under the specified key.
+func (m *ConcurrentMapStringEpoch) Set(key string, value interface{}) {
+	m.shardOf(key).update(func(items map[string]interface{}) {
+		items[key] = value
+	})
+}
+
+// Retrieves an element from map under given key, without locking.
+func (m *ConcurrentMapStringEpoch) Get(key string) (interface{}, bool) {
+	shard := m.shardOf(key)
+	e := shard.enter()
+	val, ok := shard.load()[key]
+	shard.exit(e)
+	return val, ok
+}
+
+// Looks up an item under specified key, without locking.
+func (m *ConcurrentMapStringEpoch) Has(key string) bool {
+	_, ok := m.Get(key)
+	return ok
+}
+
+// Removes an element from the map.
+func (m *ConcurrentMapStringEpoch) Remove(key string) {
+	if !m.Has(key) {
+		return
+	}
+	m.shardOf(key).update(func(items map[string]interface{}) {
+		delete(items, key)
+	})
+}
+
+// Returns the number of elements within the map.
+func (m *ConcurrentMapStringEpoch) Count() int {
+	count := 0
+	for _, shard := range m.shards {
+		e := shard.enter()
+		count += len(shard.load())
+		shard.exit(e)
+	}
+	return count
+}
+
+// Returns all keys as []string.
+func (m *ConcurrentMapStringEpoch) Keys() []string {
+	keys := make([]string, 0, m.Count())
+	for _, shard := range m.shards {
+		e := shard.enter()
+		for key := range shard.load() {
+			keys = append(keys, key)
+		}
+		shard.exit(e)
+	}
+	return keys
+}
+
+// Callback based iterator over the current snapshot of every shard. fn may
+// access the map, writes are not seen by the ongoing iteration of their shard
+// and allocate a new map until it moved on to the next shard.
+func (m *ConcurrentMapStringEpoch) IterCb(fn IterCb) {
+	for _, shard := range m.shards {
+		e := shard.enter()
+		for key, val := range shard.load() {
+			fn(key, val)
+		}
+		shard.exit(e)
+	}
+}
@@ -0,0 +1,96 @@
+package util
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Writers store key+":"+n under every key while readers check that each value
+// they see belongs to its key, which a map reused too early would violate.
+func TestEpochConcurrentWrites(t *testing.T) {
+	m := NewConcurrentMapStringEpoch(4)
+	const keys = 16
+	var stop int32
+	var writers, readers sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for i := 0; i < 3000; i++ {
+				key := strconv.Itoa((i + w) % keys)
+				if i%7 == 0 {
+					m.Remove(key)
+				} else {
+					m.Set(key, key+":"+strconv.Itoa(i))
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				for k := 0; k < keys; k++ {
+					key := strconv.Itoa(k)
+					if v, ok := m.Get(key); ok && !strings.HasPrefix(v.(string), key+":") {
+						t.Errorf("Get(%q) = %v", key, v)
+					}
+				}
+				m.IterCb(func(key string, v interface{}) {
+					if !strings.HasPrefix(v.(string), key+":") {
+						t.Errorf("IterCb got %q = %v", key, v)
+					}
+				})
+			}
+		}()
+	}
+	writers.Wait()
+	atomic.StoreInt32(&stop, 1)
+	readers.Wait()
+	if n := len(m.Keys()); n != m.Count() {
+		t.Fatalf("%d keys, Count() = %d", n, m.Count())
+	}
+}
+
+func TestEpochReusesMaps(t *testing.T) {
+	m := NewConcurrentMapStringEpoch(1)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i%10), i)
+	}
+	//without readers every write reuses a map retired two writes before
+	if allocs := testing.AllocsPerRun(100, func() { m.Set("1", 2) }); allocs > 1 {
+		t.Fatalf("Set allocates %v times", allocs)
+	}
+	if v, ok := m.Get("1"); !ok || v != 2 || m.Count() != 10 {
+		t.Fatalf("Get(1) = %v, %v, Count() = %d", v, ok, m.Count())
+	}
+}
+
+// Read throughput with one writer among the parallel goroutines.
+func benchmarkReadMostly(b *testing.B, m ConcurrentMap) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		m.Set(keys[i], i)
+	}
+	var goroutines int32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		writer := atomic.AddInt32(&goroutines, 1) == 1
+		for i := 0; pb.Next(); i++ {
+			if writer && i%64 == 0 {
+				m.Set(keys[i%len(keys)], i)
+			} else {
+				m.Get(keys[i%len(keys)])
+			}
+		}
+	})
+}
+
+func BenchmarkReadMostlyEpoch(b *testing.B)   { benchmarkReadMostly(b, NewConcurrentMapStringEpoch(32)) }
+func BenchmarkReadMostlyCOW(b *testing.B)     { benchmarkReadMostly(b, NewConcurrentMapStringCOW(32)) }
+func BenchmarkReadMostlyRWMutex(b *testing.B) { benchmarkReadMostly(b, NewConcurrentMapString(32)) }
@@ -0,0 +1,118 @@
+package util
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const evictionLogSize = 128 //RecentEvictions最多保留的事件数
+
+// Why an entry left the map without being removed explicitly.
+type EvictionReason string
+
+const (
+	EvictedLFU     EvictionReason = "lfu"     //LFU模式下超过LFUCapacity被淘汰
+	EvictedExpired EvictionReason = "expired" //TTL到期
+	EvictedMemory  EvictionReason = "memory"  //堆内存超过MemoryLimit被淘汰
+)
+
+// An entry evicted or expired, see RecentEvictions.
+type EvictionEvent struct {
+	Key    string
+	Reason EvictionReason
+	Time   time.Time
+}
+
+// Fixed size ring of the latest eviction events.
+type evictionLog struct {
+	lock   sync.Mutex
+	events []EvictionEvent //allocated on first use
+	next   int             //where the next event goes
+	full   bool
+}
+
+func (l *evictionLog) add(key string, reason EvictionReason, now time.Time) {
+	l.lock.Lock()
+	if l.events == nil {
+		l.events = make([]EvictionEvent, evictionLogSize)
+	}
+	l.events[l.next] = EvictionEvent{Key: key, Reason: reason, Time: now}
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+	l.lock.Unlock()
+}
+
+// Returns up to the last 128 entries evicted by the LFU mode, evicted for memory or expired, oldest
+// first. It needs no callbacks, unlike OnEvict and RegisterOnExpire.
+func (m *ConcurrentMapString) RecentEvictions() []EvictionEvent {
+	l := &m.evictions
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.full {
+		return append([]EvictionEvent(nil), l.events[:l.next]...)
+	}
+	return append(append(make([]EvictionEvent, 0, len(l.events)), l.events[l.next:]...), l.events[:l.next]...)
+}
+
+// Called after key has been inserted into the map (not on updates) and the
+// shard lock has been released. Enforces the capacity of the LFU mode and
+// triggers the automatic resize and the split of hot shards.
+func (m *ConcurrentMapString) afterInsert(key string) {
+	if m.opts.LFUCapacity > 0 && m.Count() > m.opts.LFUCapacity {
+		m.evictLFU(key)
+	}
+	if m.opts.HotShardFactor > 0 {
+		m.splitIfHot(key)
+	}
+	if m.opts.AutoResizeFactor > 0 {
+		shardCount := m.ShardCount()
+		if m.Count() > m.opts.AutoResizeFactor*shardCount && atomic.CompareAndSwapInt32(&m.resizing, 0, 1) {
+			go func() {
+				m.Resize(shardCount * 2)
+				atomic.StoreInt32(&m.resizing, 0)
+			}()
+		}
+	}
+}
+
+// Evicts the least frequently read entry of the shard that owns key, except key
+// itself which has just been inserted. The LFU is approximated per shard, so
+// nothing is evicted if key is alone in its shard and Count() may briefly
+// exceed LFUCapacity.
+func (m *ConcurrentMapString) evictLFU(key string) {
+	shard := m.lockShard(key)
+	victim, value, ok := shard.leastFrequent(key)
+	if ok {
+		shard.remove(victim)
+	}
+	shard.Unlock()
+	if ok {
+		m.evictions.add(victim, EvictedLFU, m.now())
+	}
+	if ok && m.opts.OnEvict != nil {
+		m.opts.OnEvict(victim, m.Uncompress(value))
+	}
+}
+
+// Returns the entry with the smallest access counter other than exclude, the write lock MUST be held.
+func (shard *concurrentMapSharedString) leastFrequent(exclude string) (string, interface{}, bool) {
+	var victim string
+	var min uint32
+	found := false
+	for key, freq := range shard.freqs {
+		if key == exclude {
+			continue
+		}
+		if !found || *freq < min {
+			victim, min, found = key, *freq, true
+		}
+	}
+	if !found {
+		return "", nil, false
+	}
+	value, _ := shard.lookup(victim)
+	return victim, value, true
+}
@@ -0,0 +1,85 @@
+package util
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLFUKeepsFrequentKeys(t *testing.T) {
+	var evicted []string
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{
+		ShardCount:  1,
+		LFUCapacity: 10,
+		OnEvict: func(key string, value interface{}) {
+			evicted = append(evicted, key)
+		},
+	})
+	m.Set("hot", 0)
+	for i := 0; i < 50; i++ {
+		m.Get("hot")
+		m.Set(strconv.Itoa(i), i)
+	}
+	if !m.Has("hot") {
+		t.Fatal("the frequently read key was evicted")
+	}
+	if m.Count() != 10 {
+		t.Fatalf("Count() = %d, want the capacity 10", m.Count())
+	}
+	if len(evicted) != 41 {
+		t.Fatalf("OnEvict called %d times, want 41", len(evicted))
+	}
+	for _, key := range evicted {
+		if key == "hot" {
+			t.Fatal("OnEvict got the frequently read key")
+		}
+	}
+}
+
+func TestAutoResize(t *testing.T) {
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 2, AutoResizeFactor: 4})
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	waitFor(t, "the shard count to grow", func() bool { return m.ShardCount() > 2 })
+	for i := 0; i < 100; i++ {
+		if v, ok := m.Get(strconv.Itoa(i)); !ok || v != i {
+			t.Fatalf("Get(%d) = %v, %v after the resize", i, v, ok)
+		}
+	}
+}
+
+func TestRecentEvictions(t *testing.T) {
+	clock := newFakeClock()
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 1, LFUCapacity: 2, Clock: clock})
+	m.SetWithTTL("ttl", 0, time.Second)
+	clock.Advance(time.Minute)
+	m.Get("ttl")
+	for i := 0; i < 4; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	events := m.RecentEvictions()
+	if len(events) != 3 {
+		t.Fatalf("RecentEvictions() = %v, want 3 events", events)
+	}
+	if events[0].Key != "ttl" || events[0].Reason != EvictedExpired || !events[0].Time.Equal(clock.Now()) {
+		t.Fatalf("first event %v, want the expiration of ttl", events[0])
+	}
+	for _, e := range events[1:] {
+		if e.Reason != EvictedLFU {
+			t.Fatalf("event %v, want an LFU eviction", e)
+		}
+	}
+
+	for i := 0; i < 2*evictionLogSize; i++ {
+		m.Set("more"+strconv.Itoa(i), i)
+	}
+	events = m.RecentEvictions()
+	if len(events) != evictionLogSize {
+		t.Fatalf("RecentEvictions() has %d events, want the ring size %d", len(events), evictionLogSize)
+	}
+	if last := events[len(events)-1].Key; last == "more"+strconv.Itoa(2*evictionLogSize-1) || !strings.HasPrefix(last, "more") {
+		t.Fatalf("the newest event evicted %s", last)
+	}
+}
@@ -0,0 +1,145 @@
+package util
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// The secondary indexes of a map.
+type indexSet struct {
+	n       int32 // len(indexes), read atomically so that maps without indexes skip the lock
+	lock    sync.RWMutex
+	indexes map[string]*secondaryIndex
+}
+
+// Maps the keys derived from the values by keyFunc to the set of keys holding
+// such values.
+type secondaryIndex struct {
+	keyFunc func(v interface{}) string
+	entries map[string]map[string]struct{}
+}
+
+func (idx *secondaryIndex) add(key string, v interface{}) {
+	indexKey := idx.keyFunc(v)
+	keys, ok := idx.entries[indexKey]
+	if !ok {
+		keys = make(map[string]struct{})
+		idx.entries[indexKey] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+func (idx *secondaryIndex) drop(key string, v interface{}) {
+	indexKey := idx.keyFunc(v)
+	if keys, ok := idx.entries[indexKey]; ok {
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(idx.entries, indexKey)
+		}
+	}
+}
+
+// Indexes key holding v, the write lock of its shard MUST be held.
+func (s *indexSet) add(key string, v interface{}) {
+	if s == nil || atomic.LoadInt32(&s.n) == 0 {
+		return
+	}
+	s.lock.Lock()
+	for _, idx := range s.indexes {
+		idx.add(key, v)
+	}
+	s.lock.Unlock()
+}
+
+// Unindexes key holding v, the write lock of its shard MUST be held.
+func (s *indexSet) drop(key string, v interface{}) {
+	if s == nil || atomic.LoadInt32(&s.n) == 0 {
+		return
+	}
+	s.lock.Lock()
+	for _, idx := range s.indexes {
+		idx.drop(key, v)
+	}
+	s.lock.Unlock()
+}
+
+// Indexes all the entries of shard, its write lock MUST be held.
+func (s *indexSet) addAll(shard *concurrentMapSharedString) {
+	if s == nil || atomic.LoadInt32(&s.n) == 0 {
+		return
+	}
+	s.lock.Lock()
+	for _, idx := range s.indexes {
+		shard.rangeItems(func(key string, v interface{}) bool {
+			idx.add(key, v)
+			return true
+		})
+	}
+	s.lock.Unlock()
+}
+
+// Unindexes all the entries of shard, its write lock MUST be held.
+func (s *indexSet) dropAll(shard *concurrentMapSharedString) {
+	if s == nil || atomic.LoadInt32(&s.n) == 0 {
+		return
+	}
+	s.lock.Lock()
+	for _, idx := range s.indexes {
+		shard.rangeItems(func(key string, v interface{}) bool {
+			idx.drop(key, v)
+			return true
+		})
+	}
+	s.lock.Unlock()
+}
+
+// Adds a secondary index called name mapping keyFunc(value) to the keys holding
+// such values, e.g. to look up entries by a field of their values without a
+// full scan. It indexes the current entries and is kept up to date by every
+// write afterwards. keyFunc is called with the stored values (a
+// *CompressedValue in the CompressThreshold mode) while shard locks are held,
+// so it MUST be fast, deterministic and MUST NOT access the map. Adding an
+// index under an existing name replaces it.
+func (m *ConcurrentMapString) AddIndex(name string, keyFunc func(v interface{}) string) {
+	tables := m.shards()
+	idx := &secondaryIndex{keyFunc: keyFunc, entries: make(map[string]map[string]struct{})}
+	m.indexes.lock.Lock()
+	if m.indexes.indexes == nil {
+		m.indexes.indexes = make(map[string]*secondaryIndex)
+	}
+	m.indexes.indexes[name] = idx
+	atomic.StoreInt32(&m.indexes.n, int32(len(m.indexes.indexes)))
+	m.indexes.lock.Unlock()
+	//writes from now on maintain idx, index what was there before them
+	for _, shard := range tables {
+		shard.RLock()
+		if !shard.retired {
+			//the entries of retired shards were copied to their successors by set, indexing them
+			m.indexes.lock.Lock()
+			shard.rangeItems(func(key string, v interface{}) bool {
+				idx.add(key, v)
+				return true
+			})
+			m.indexes.lock.Unlock()
+		}
+		shard.RUnlock()
+	}
+}
+
+// Returns the keys whose value keyFunc of the index called name maps to
+// indexKey, sorted. Returns nil if there is no such index.
+func (m *ConcurrentMapString) LookupByIndex(name, indexKey string) []string {
+	m.indexes.lock.RLock()
+	defer m.indexes.lock.RUnlock()
+	idx, ok := m.indexes.indexes[name]
+	if !ok {
+		return nil
+	}
+	keys := make([]string, 0, len(idx.entries[indexKey]))
+	for key := range idx.entries[indexKey] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
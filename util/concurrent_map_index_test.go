@@ -0,0 +1,47 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+type indexedUser struct {
+	Name string
+	City string
+}
+
+func TestSecondaryIndex(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	m.Set("1", indexedUser{"ann", "paris"})
+	m.Set("2", indexedUser{"bob", "rome"})
+	m.AddIndex("city", func(v interface{}) string {
+		return v.(indexedUser).City
+	})
+	m.Set("3", indexedUser{"cid", "paris"})
+
+	check := func(city string, want ...string) {
+		t.Helper()
+		if got := m.LookupByIndex("city", city); len(got)+len(want) > 0 && !reflect.DeepEqual(got, want) {
+			t.Fatalf("LookupByIndex(city, %s) = %v, want %v", city, got, want)
+		}
+	}
+	check("paris", "1", "3")
+	check("rome", "2")
+
+	m.Set("1", indexedUser{"ann", "rome"}) //moved
+	check("paris", "3")
+	check("rome", "1", "2")
+	m.Remove("2")
+	check("rome", "1")
+	m.MapValues(func(key string, v interface{}) interface{} {
+		u := v.(indexedUser)
+		u.City = "oslo"
+		return u
+	})
+	check("rome")
+	check("oslo", "1", "3")
+
+	if got := m.LookupByIndex("missing", "oslo"); got != nil {
+		t.Fatalf("LookupByIndex() of a missing index = %v", got)
+	}
+}
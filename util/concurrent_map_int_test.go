@@ -0,0 +1,99 @@
+package util
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentMapInt(t *testing.T) {
+	m := NewConcurrentMapInt(4)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.Upsert(strconv.Itoa(j%10), 1, func(exist bool, valueInMap, newValue int) int {
+					return valueInMap + newValue
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if m.Count() != 10 {
+		t.Fatalf("Count() = %d, want 10", m.Count())
+	}
+	sum := 0
+	for item := range m.IterBuffered() {
+		sum += item.Val
+	}
+	if sum != 800 {
+		t.Fatalf("the counters sum up to %d, want 800", sum)
+	}
+
+	if m.SetIfAbsent("0", 5) || !m.SetIfAbsent("new", 5) {
+		t.Fatal("SetIfAbsent ignored the present key or rejected the absent one")
+	}
+	m.Set("0", -1)
+	if v, ok := m.Get("0"); !ok || v != -1 {
+		t.Fatalf("Get(0) = %d, %v", v, ok)
+	}
+	m.Remove("new")
+	if m.Has("new") {
+		t.Fatal("Remove left the key")
+	}
+	keys := m.Keys()
+	sort.Strings(keys)
+	if len(keys) != 10 || keys[0] != "0" || keys[9] != "9" {
+		t.Fatalf("Keys() = %v", keys)
+	}
+}
+
+func TestConcurrentStrStrMap(t *testing.T) {
+	m := NewConcurrentStrStrMap(4)
+	m.Set("a", "x")
+	m.Set("b", "y")
+	got := make(map[string]string)
+	m.IterCb(func(key string, v string) {
+		got[key] = v
+	})
+	if len(got) != 2 || got["a"] != "x" || got["b"] != "y" {
+		t.Fatalf("IterCb yielded %v", got)
+	}
+	if v, ok := m.Get("missing"); ok || v != "" {
+		t.Fatalf("Get(missing) = %q, %v", v, ok)
+	}
+}
+
+func TestTypedIterBuffered(t *testing.T) {
+	ints := NewConcurrentMapInt(4)
+	strs := NewConcurrentStrStrMap(4)
+	for i := 0; i < 100; i++ {
+		ints.Set(strconv.Itoa(i), i)
+		strs.Set(strconv.Itoa(i), "v"+strconv.Itoa(i))
+	}
+	seen := make(map[string]bool)
+	for item := range ints.IterBuffered() {
+		var v int = item.Val //typed, no assertion
+		if strconv.Itoa(v) != item.Key || seen[item.Key] {
+			t.Fatalf("ConcurrentMapInt.IterBuffered yielded %+v", item)
+		}
+		seen[item.Key] = true
+	}
+	if len(seen) != 100 {
+		t.Fatalf("ConcurrentMapInt.IterBuffered yielded %d entries, want 100", len(seen))
+	}
+	n := 0
+	for item := range strs.IterBuffered() {
+		var v string = item.Val
+		if v != "v"+item.Key {
+			t.Fatalf("ConcurrentStrStrMap.IterBuffered yielded %+v", item)
+		}
+		n++
+	}
+	if n != 100 {
+		t.Fatalf("ConcurrentStrStrMap.IterBuffered yielded %d entries, want 100", n)
+	}
+}
@@ -0,0 +1,75 @@
+package util
+
+import (
+	"sort"
+	"sync"
+)
+
+// Mutexes of the keys locked by LockKey whose hash falls into this shard.
+type keyLockShard struct {
+	lock  sync.Mutex
+	locks map[string]*keyLock //allocated on first use
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int //holders and waiters, the entry is deleted when it drops to 0
+}
+
+// Locks key against the other LockKey callers on the same key and returns the
+// function releasing it. Unlike the shard locks it may be held across I/O, e.g.
+// read, call a backend, then write, while other keys of the shard proceed. It
+// is advisory: plain Get and Set on key are not blocked. Not reentrant.
+func (m *ConcurrentMapString) LockKey(key string) (unlock func()) {
+	key = m.normalize(key)
+	shard := &m.keyLocks[fnv32(key)%uint32(len(m.keyLocks))]
+	shard.lock.Lock()
+	if shard.locks == nil {
+		shard.locks = make(map[string]*keyLock)
+	}
+	l, ok := shard.locks[key]
+	if !ok {
+		l = &keyLock{}
+		shard.locks[key] = l
+	}
+	l.refs++
+	shard.lock.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		shard.lock.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(shard.locks, key)
+		}
+		shard.lock.Unlock()
+	}
+}
+
+// Locks all of keys like LockKey and returns the function releasing them. The
+// keys are locked in ascending order, so concurrent LockKeys calls on
+// overlapping keys cannot deadlock. Key locks MUST be taken before any shard
+// lock, which MGet, MRemove and the other methods of the map only hold inside
+// the call.
+func (m *ConcurrentMapString) LockKeys(keys []string) (unlock func()) {
+	normalized := make([]string, 0, len(keys))
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		key = m.normalize(key)
+		if !seen[key] {
+			seen[key] = true
+			normalized = append(normalized, key)
+		}
+	}
+	sort.Strings(normalized)
+	unlocks := make([]func(), len(normalized))
+	for i, key := range normalized {
+		unlocks[i] = m.LockKey(key)
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
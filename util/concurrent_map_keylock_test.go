@@ -0,0 +1,84 @@
+package util
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockKey(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	m.Set("counter", 0)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := m.LockKey("counter")
+			defer unlock()
+			v, _ := m.Get("counter")
+			time.Sleep(5 * time.Millisecond) //the I/O
+			m.Set("counter", v.(int)+1)
+		}()
+	}
+	wg.Wait()
+	if v, _ := m.Get("counter"); v != 4 {
+		t.Fatalf("counter = %v, an update under LockKey was lost", v)
+	}
+
+	//another key proceeds while one is held
+	unlock := m.LockKey("x")
+	withinSecond(t, "LockKey on another key", func() {
+		m.LockKey("y")()
+	})
+	locked := make(chan struct{})
+	go func() {
+		m.LockKey("x")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("LockKey on a held key did not wait")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+}
+
+func TestLockKeysWithBatchesStress(t *testing.T) {
+	m := NewConcurrentMapString(8)
+	keys := make([]string, 32)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	withinSecond(t, "LockKeys mixed with MGet and MRemove", func() {
+		wg := sync.WaitGroup{}
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(int64(w)))
+				for i := 0; i < 200; i++ {
+					batch := make([]string, 1+r.Intn(6))
+					for j := range batch {
+						batch[j] = keys[r.Intn(len(keys))]
+					}
+					switch r.Intn(3) {
+					case 0:
+						unlock := m.LockKeys(batch)
+						m.MGet(keys)
+						m.MSet(map[string]interface{}{batch[0]: i})
+						unlock()
+					case 1:
+						m.MGet(batch)
+					case 2:
+						m.MRemove(batch)
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+	})
+}
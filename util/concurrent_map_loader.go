@@ -0,0 +1,245 @@
+package util
+
+import (
+	"fmt"
+	"time"
+)
+
+// Error returned when the Loader fails, it matches ErrLoaderFailed with
+// errors.Is and unwraps to the error of the Loader.
+type LoaderError struct {
+	Key string
+	Err error
+}
+
+func (e *LoaderError) Error() string {
+	return ErrLoaderFailed.Error() + ": " + e.Key + ": " + e.Err.Error()
+}
+
+func (e *LoaderError) Unwrap() error {
+	return e.Err
+}
+
+func (e *LoaderError) Is(target error) bool {
+	return target == ErrLoaderFailed
+}
+
+// A Loader call in flight, shared by all the callers missing the same key.
+type loadCall struct {
+	done chan struct{}
+	val  interface{}
+	ok   bool
+	err  error
+}
+
+// Retrieves an element from map under given key. On a miss the Loader option
+// is called outside the shard lock and a found value is stored unless the key
+// was set meanwhile. Concurrent misses of the same key share a single Loader
+// call. Loaded values expire after HardTTL; past SoftTTL they are still
+// returned while a single background Loader call refreshes them.
+// The error of the Loader, or its panic, is returned as a *LoaderError,
+// without a Loader it never fails.
+func (m *ConcurrentMapString) GetOrLoad(key string) (interface{}, bool, error) {
+	key = m.normalize(key)
+	val, ok := m.get(key)
+	if m.opts.Loader == nil {
+		return val, ok, nil
+	}
+	if !ok {
+		return m.load(key)
+	}
+	if m.opts.SoftTTL > 0 && m.softExpired(key) {
+		m.refresh(key)
+	}
+	return val, true, nil
+}
+
+// Calls the Loader for the normalized key, or waits for the call in flight.
+func (m *ConcurrentMapString) load(key string) (interface{}, bool, error) {
+	m.loadLock.Lock()
+	if call, ok := m.loads[key]; ok {
+		m.loadLock.Unlock()
+		<-call.done
+		return call.val, call.ok, call.err
+	}
+	if val, ok := m.peek(key); ok {
+		//stored by a call which finished after our miss
+		m.loadLock.Unlock()
+		return val, true, nil
+	}
+	call := m.registerLoad(key)
+	m.loadLock.Unlock()
+	m.runLoad(key, call, false)
+	return call.val, call.ok, call.err
+}
+
+// Starts a background Loader call refreshing key, unless one is in flight.
+func (m *ConcurrentMapString) refresh(key string) {
+	m.loadLock.Lock()
+	defer m.loadLock.Unlock()
+	if _, ok := m.loads[key]; ok {
+		return
+	}
+	call := m.registerLoad(key)
+	go m.runLoad(key, call, true)
+}
+
+// Returns the value under key unless it expired. Unlike get it neither removes
+// an expired entry nor fires the OnExpire hooks, which may call back into the
+// map, so it is safe under loadLock. The callers did the full get before.
+func (m *ConcurrentMapString) peek(key string) (interface{}, bool) {
+	shard := m.rlockShard(key)
+	val, ok := shard.lookup(key)
+	if ok && shard.expired(key, m.now()) {
+		val, ok = nil, false
+	}
+	shard.RUnlock()
+	return m.Uncompress(val), ok
+}
+
+// Records a Loader call in flight for key, loadLock MUST be held.
+func (m *ConcurrentMapString) registerLoad(key string) *loadCall {
+	call := &loadCall{done: make(chan struct{})}
+	if m.loads == nil {
+		m.loads = make(map[string]*loadCall)
+	}
+	m.loads[key] = call
+	return call
+}
+
+// Calls the Loader and stores what it found. Unless overwrite is set, a value
+// stored by somebody else meanwhile wins over the loaded one. A panic of the
+// Loader completes the call with a *LoaderError, the waiters would hang otherwise.
+func (m *ConcurrentMapString) runLoad(key string, call *loadCall, overwrite bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			call.val, call.ok = nil, false
+			call.err = &LoaderError{Key: key, Err: fmt.Errorf("panic: %v", r)}
+		}
+		m.loadLock.Lock()
+		delete(m.loads, key)
+		m.loadLock.Unlock()
+		close(call.done)
+	}()
+	call.val, call.ok, call.err = m.opts.Loader(key)
+	if call.err != nil {
+		call.val, call.ok = nil, false
+		call.err = &LoaderError{Key: key, Err: call.err}
+	} else if m.rejectsNil(call.val) {
+		call.ok = false
+	} else if call.ok {
+		call.val = m.storeLoaded(key, call.val, overwrite)
+	}
+}
+
+// Stores a loaded value with the HardTTL deadline and returns the value now in
+// the map.
+func (m *ConcurrentMapString) storeLoaded(key string, val interface{}, overwrite bool) interface{} {
+	now := m.now()
+	room := m.room()
+	shard := m.lockShard(key)
+	if old, ok := shard.lookup(key); ok && !overwrite && !shard.expired(key, now) {
+		shard.Unlock()
+		return m.Uncompress(old)
+	}
+	inserted, err := m.store(shard, key, val, &room)
+	if err != nil {
+		shard.Unlock()
+		return val
+	}
+	if m.opts.HardTTL > 0 {
+		if shard.expires == nil {
+			shard.expires = make(map[string]time.Time)
+		}
+		shard.expires[key] = now.Add(m.opts.HardTTL)
+	}
+	shard.Unlock()
+	if inserted {
+		m.afterInsert(key)
+	}
+	return val
+}
+
+// Reports whether the value under key is past its SoftTTL: it is still served
+// but should be refreshed. Loaded values reach it HardTTL-SoftTTL before their
+// deadline.
+func (m *ConcurrentMapString) softExpired(key string) bool {
+	shard := m.rlockShard(key)
+	deadline, ok := shard.expires[key]
+	shard.RUnlock()
+	return ok && !m.now().Before(deadline.Add(m.opts.SoftTTL-m.opts.HardTTL))
+}
+
+// Returns the values of keys, computing the missing ones with a single call of
+// loader, e.g. for cache-aside batch lookups against a backend. loader gets the
+// missing normalized keys and returns the values it found, which are stored
+// unless the keys were set meanwhile. Keys being loaded by a concurrent call
+// (of this method or the Loader) are waited for instead of loaded twice. Keys
+// found nowhere are absent from the result, which is keyed by normalized keys.
+func (m *ConcurrentMapString) GetOrComputeMany(keys []string, loader func(missing []string) map[string]interface{}) map[string]interface{} {
+	result := m.MGet(keys)
+	var mine []string
+	var mineCalls []*loadCall
+	waiting := make(map[string]*loadCall)
+	m.loadLock.Lock()
+	for _, key := range keys {
+		key = m.normalize(key)
+		if _, ok := result[key]; ok {
+			continue
+		}
+		if _, ok := waiting[key]; ok {
+			continue
+		}
+		if call, ok := m.loads[key]; ok {
+			waiting[key] = call
+			continue
+		}
+		if val, ok := m.peek(key); ok {
+			//stored by a call which finished after our miss
+			result[key] = val
+			continue
+		}
+		call := m.registerLoad(key)
+		waiting[key] = call
+		mine = append(mine, key)
+		mineCalls = append(mineCalls, call)
+	}
+	m.loadLock.Unlock()
+
+	if len(mine) > 0 {
+		m.computeMany(mine, mineCalls, loader)
+	}
+	for key, call := range waiting {
+		<-call.done
+		if call.ok {
+			result[key] = call.val
+		}
+	}
+	return result
+}
+
+// Calls loader for the keys registered with calls and completes the calls,
+// even if loader panics.
+func (m *ConcurrentMapString) computeMany(keys []string, calls []*loadCall, loader func(missing []string) map[string]interface{}) {
+	defer func() {
+		m.loadLock.Lock()
+		for _, key := range keys {
+			delete(m.loads, key)
+		}
+		m.loadLock.Unlock()
+		for _, call := range calls {
+			close(call.done)
+		}
+	}()
+	found := loader(keys)
+	for i, key := range keys {
+		val, ok := found[key]
+		if !ok {
+			continue
+		}
+		if actual, loaded := m.getOrSet(key, val); loaded {
+			val = actual
+		}
+		calls[i].val, calls[i].ok = val, true
+	}
+}
@@ -0,0 +1,220 @@
+package util
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A Clock only moving when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// Fails if fn does not return within a second.
+func withinSecond(t *testing.T, what string, fn func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("%s deadlocked", what)
+	}
+}
+
+func TestLoaderWithHookCallingBack(t *testing.T) {
+	clock := newFakeClock()
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{
+		ShardCount: 4,
+		Clock:      clock,
+		Loader: func(key string) (interface{}, bool, error) {
+			return "loaded " + key, true, nil
+		},
+	})
+	m.RegisterOnExpire(func(key string, value interface{}) {
+		m.GetOrLoad("other")
+	})
+	m.SetWithTTL("a", 1, time.Second)
+	m.SetWithTTL("b", 2, time.Second)
+	clock.Advance(2 * time.Second)
+
+	withinSecond(t, "GetOrComputeMany", func() {
+		m.GetOrComputeMany([]string{"a"}, func(missing []string) map[string]interface{} {
+			return map[string]interface{}{"a": 3}
+		})
+	})
+	withinSecond(t, "GetOrLoad", func() {
+		if v, ok, err := m.GetOrLoad("b"); !ok || err != nil || v != "loaded b" {
+			t.Errorf("GetOrLoad(b) = %v, %v, %v", v, ok, err)
+		}
+	})
+}
+
+// Fails unless cond becomes true within a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLoaderSingleFlight(t *testing.T) {
+	var calls int32
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{
+		ShardCount: 4,
+		Loader: func(key string) (interface{}, bool, error) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(20 * time.Millisecond)
+			return "loaded " + key, true, nil
+		},
+	})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, ok, err := m.GetOrLoad("k"); v != "loaded k" || !ok || err != nil {
+				t.Errorf("GetOrLoad(k) = %v, %v, %v", v, ok, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("the Loader was called %d times, want 1", calls)
+	}
+	if v, _ := m.Get("k"); v != "loaded k" {
+		t.Fatalf("Get(k) = %v, the loaded value was not stored", v)
+	}
+}
+
+func TestLoaderStaleWhileRevalidate(t *testing.T) {
+	clock := newFakeClock()
+	var calls int32
+	gate := make(chan struct{}, 1)
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{
+		ShardCount: 4,
+		Clock:      clock,
+		SoftTTL:    time.Second,
+		HardTTL:    10 * time.Second,
+		Loader: func(key string) (interface{}, bool, error) {
+			n := atomic.AddInt32(&calls, 1)
+			if n > 1 {
+				<-gate
+			}
+			return n, true, nil
+		},
+	})
+	if v, _, _ := m.GetOrLoad("k"); v != int32(1) {
+		t.Fatalf("GetOrLoad(k) = %v on the first load", v)
+	}
+
+	//soft expired: the stale value comes back at once, one refresh runs behind it
+	clock.Advance(2 * time.Second)
+	for i := 0; i < 5; i++ {
+		withinSecond(t, "a soft expired GetOrLoad", func() {
+			if v, ok, err := m.GetOrLoad("k"); v != int32(1) || !ok || err != nil {
+				t.Errorf("GetOrLoad(k) = %v, %v, %v past SoftTTL, want the stale value", v, ok, err)
+			}
+		})
+	}
+	gate <- struct{}{}
+	waitFor(t, "the refreshed value", func() bool {
+		v, _ := m.Get("k")
+		return v == int32(2)
+	})
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("the Loader was called %d times, want a single refresh", n)
+	}
+
+	//hard expired: GetOrLoad waits for the Loader
+	clock.Advance(11 * time.Second)
+	gate <- struct{}{}
+	if v, _, _ := m.GetOrLoad("k"); v != int32(3) {
+		t.Fatalf("GetOrLoad(k) = %v past HardTTL, want the reloaded value", v)
+	}
+}
+
+func TestGetOrComputeMany(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	m.MSet(map[string]interface{}{"a": 1, "b": 2})
+	var calls [][]string
+	loader := func(missing []string) map[string]interface{} {
+		calls = append(calls, append([]string(nil), missing...))
+		found := make(map[string]interface{})
+		for _, key := range missing {
+			if key != "nowhere" {
+				found[key] = "loaded " + key
+			}
+		}
+		return found
+	}
+	got := m.GetOrComputeMany([]string{"a", "x", "b", "y", "x", "nowhere"}, loader)
+	want := map[string]interface{}{"a": 1, "b": 2, "x": "loaded x", "y": "loaded y"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("GetOrComputeMany() = %v, want %v", got, want)
+	}
+	if len(calls) != 1 {
+		t.Fatalf("the loader was called %d times, want once", len(calls))
+	}
+	sort.Strings(calls[0])
+	if !reflect.DeepEqual(calls[0], []string{"nowhere", "x", "y"}) {
+		t.Fatalf("the loader got %v, want the missing keys", calls[0])
+	}
+	if v, _ := m.Get("x"); v != "loaded x" || m.Has("nowhere") {
+		t.Fatal("the loaded values were not stored, or a key found nowhere was")
+	}
+
+	//overlapping concurrent calls load each key once
+	var loaded int32
+	slow := func(missing []string) map[string]interface{} {
+		atomic.AddInt32(&loaded, int32(len(missing)))
+		time.Sleep(20 * time.Millisecond)
+		found := make(map[string]interface{})
+		for _, key := range missing {
+			found[key] = key
+		}
+		return found
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := m.GetOrComputeMany([]string{"p", "q", "r"}, slow); len(got) != 3 {
+				t.Errorf("GetOrComputeMany() = %v", got)
+			}
+		}()
+	}
+	wg.Wait()
+	if loaded != 3 {
+		t.Fatalf("%d keys were loaded for 3 distinct missing keys", loaded)
+	}
+}
@@ -0,0 +1,318 @@
+package util
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// The lock guarding a shard, *sync.RWMutex by default.
+type rwLocker interface {
+	Lock()
+	Unlock()
+	RLock()
+	RUnlock()
+	TryLock() bool
+	TryRLock() bool
+}
+
+func newLocker(opts *ConcurrentMapStringOpts) rwLocker {
+	if opts.SpinLock {
+		return new(spinLock)
+	}
+	if opts.WriterPreferring {
+		return newWriterPreferringLock()
+	}
+	if opts.AdaptiveLock {
+		return &adaptiveLock{threshold: opts.AdaptiveLockThreshold}
+	}
+	return new(sync.RWMutex)
+}
+
+// Returns the kind of lock of each shard: "rwmutex", "spin",
+// "writer-preferring", or for the AdaptiveLock mode "adaptive:rwmutex" until
+// the shard switched and "adaptive:writer-preferring" afterwards.
+func (m *ConcurrentMapString) LockModes() []string {
+	tables := m.shards()
+	modes := make([]string, len(tables))
+	for i, shard := range tables {
+		modes[i] = lockMode(shard.rwLocker)
+	}
+	return modes
+}
+
+func lockMode(l rwLocker) string {
+	switch lock := l.(type) {
+	case *spinLock:
+		return "spin"
+	case *writerPreferringLock:
+		return "writer-preferring"
+	case *adaptiveLock:
+		if atomic.LoadInt32(&lock.mode) == adaptiveWriterPreferring {
+			return "adaptive:writer-preferring"
+		}
+		return "adaptive:rwmutex"
+	default:
+		return "rwmutex"
+	}
+}
+
+const spinsBeforeYield = 16
+
+// A reader/writer spinlock built on a CAS loop, which yields the processor
+// after spinning for a while. It is cheaper than sync.RWMutex when the critical
+// sections are tiny, but wastes CPU and may starve writers when they are long.
+type spinLock struct {
+	state int32 // -1: held by a writer, n >= 0: held by n readers
+}
+
+func (l *spinLock) Lock() {
+	for i := 1; !atomic.CompareAndSwapInt32(&l.state, 0, -1); i++ {
+		if i%spinsBeforeYield == 0 {
+			runtime.Gosched()
+		}
+	}
+}
+
+func (l *spinLock) Unlock() {
+	atomic.StoreInt32(&l.state, 0)
+}
+
+func (l *spinLock) RLock() {
+	for i := 1; ; i++ {
+		state := atomic.LoadInt32(&l.state)
+		if state >= 0 && atomic.CompareAndSwapInt32(&l.state, state, state+1) {
+			return
+		}
+		if i%spinsBeforeYield == 0 {
+			runtime.Gosched()
+		}
+	}
+}
+
+func (l *spinLock) RUnlock() {
+	atomic.AddInt32(&l.state, -1)
+}
+
+func (l *spinLock) TryLock() bool {
+	return atomic.CompareAndSwapInt32(&l.state, 0, -1)
+}
+
+func (l *spinLock) TryRLock() bool {
+	state := atomic.LoadInt32(&l.state)
+	return state >= 0 && atomic.CompareAndSwapInt32(&l.state, state, state+1)
+}
+
+// A reader/writer lock built on a mutex and two conditions. Once a writer is
+// waiting no new reader gets in, and a releasing writer hands the lock to the
+// next waiting writer before any reader, so writers are never starved by a
+// steady stream of readers. Readers may be starved by writers instead.
+type writerPreferringLock struct {
+	lock    sync.Mutex
+	readOk  *sync.Cond
+	writeOk *sync.Cond
+	readers int  // readers holding the lock
+	writing bool // a writer holds the lock
+	writers int  // writers waiting for the lock
+}
+
+func newWriterPreferringLock() *writerPreferringLock {
+	l := &writerPreferringLock{}
+	l.readOk = sync.NewCond(&l.lock)
+	l.writeOk = sync.NewCond(&l.lock)
+	return l
+}
+
+func (l *writerPreferringLock) Lock() {
+	l.lock.Lock()
+	l.writers++
+	for l.writing || l.readers > 0 {
+		l.writeOk.Wait()
+	}
+	l.writers--
+	l.writing = true
+	l.lock.Unlock()
+}
+
+func (l *writerPreferringLock) Unlock() {
+	l.lock.Lock()
+	l.writing = false
+	if l.writers > 0 {
+		l.writeOk.Signal()
+	} else {
+		l.readOk.Broadcast()
+	}
+	l.lock.Unlock()
+}
+
+func (l *writerPreferringLock) RLock() {
+	l.lock.Lock()
+	for l.writing || l.writers > 0 {
+		l.readOk.Wait()
+	}
+	l.readers++
+	l.lock.Unlock()
+}
+
+func (l *writerPreferringLock) RUnlock() {
+	l.lock.Lock()
+	l.readers--
+	if l.readers == 0 && l.writers > 0 {
+		l.writeOk.Signal()
+	}
+	l.lock.Unlock()
+}
+
+func (l *writerPreferringLock) TryLock() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.writing || l.readers > 0 {
+		return false
+	}
+	l.writing = true
+	return true
+}
+
+func (l *writerPreferringLock) TryRLock() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.writing || l.writers > 0 {
+		return false
+	}
+	l.readers++
+	return true
+}
+
+const (
+	adaptiveRWMutex          = 0
+	adaptiveSwitching        = 1 // decided to switch, the next acquirer does it
+	adaptiveWriterPreferring = 2
+
+	adaptiveWindow = 1024 // acquisitions the contention is measured over
+)
+
+// A lock starting as a sync.RWMutex which measures its contention, the share of
+// the acquisitions which could not get it right away. Once it reaches threshold
+// over a window it switches to a writerPreferringLock for good.
+//
+// The switch is done holding the RWMutex exclusively. Acquirers of the RWMutex
+// check the mode again once they got it and move on to the writerPreferringLock
+// if it changed meanwhile, so the two are never held at the same time. The mode
+// cannot change while the RWMutex is held, so unlocking goes by the mode.
+type adaptiveLock struct {
+	mode      int32
+	acquired  int32 // acquisitions of the current window
+	contended int32 // acquisitions of the current window which had to wait
+	threshold float64
+	rw        sync.RWMutex
+	wp        *writerPreferringLock // set before mode becomes adaptiveWriterPreferring
+}
+
+// Counts an acquisition of the RWMutex and decides to switch if the window is
+// over and was contended enough.
+func (l *adaptiveLock) count(contended bool) {
+	if contended {
+		atomic.AddInt32(&l.contended, 1)
+	}
+	if atomic.AddInt32(&l.acquired, 1) != adaptiveWindow {
+		return
+	}
+	if float64(atomic.LoadInt32(&l.contended))/adaptiveWindow >= l.threshold {
+		atomic.CompareAndSwapInt32(&l.mode, adaptiveRWMutex, adaptiveSwitching)
+	}
+	atomic.StoreInt32(&l.contended, 0)
+	atomic.StoreInt32(&l.acquired, 0)
+}
+
+// Returns whether the writerPreferringLock is in use, switching to it first if
+// that was decided. It MUST be called without holding the lock.
+func (l *adaptiveLock) switched() bool {
+	switch atomic.LoadInt32(&l.mode) {
+	case adaptiveWriterPreferring:
+		return true
+	case adaptiveSwitching:
+		l.rw.Lock()
+		if atomic.LoadInt32(&l.mode) == adaptiveSwitching {
+			l.wp = newWriterPreferringLock()
+			atomic.StoreInt32(&l.mode, adaptiveWriterPreferring)
+		}
+		l.rw.Unlock()
+		return true
+	}
+	return false
+}
+
+func (l *adaptiveLock) Lock() {
+	for !l.switched() {
+		contended := !l.rw.TryLock()
+		if contended {
+			l.rw.Lock()
+		}
+		if atomic.LoadInt32(&l.mode) == adaptiveRWMutex {
+			l.count(contended)
+			return
+		}
+		//switched while we waited
+		l.rw.Unlock()
+	}
+	l.wp.Lock()
+}
+
+func (l *adaptiveLock) Unlock() {
+	if atomic.LoadInt32(&l.mode) == adaptiveWriterPreferring {
+		l.wp.Unlock()
+	} else {
+		l.rw.Unlock()
+	}
+}
+
+func (l *adaptiveLock) RLock() {
+	for !l.switched() {
+		contended := !l.rw.TryRLock()
+		if contended {
+			l.rw.RLock()
+		}
+		if atomic.LoadInt32(&l.mode) == adaptiveRWMutex {
+			l.count(contended)
+			return
+		}
+		l.rw.RUnlock()
+	}
+	l.wp.RLock()
+}
+
+func (l *adaptiveLock) RUnlock() {
+	if atomic.LoadInt32(&l.mode) == adaptiveWriterPreferring {
+		l.wp.RUnlock()
+	} else {
+		l.rw.RUnlock()
+	}
+}
+
+func (l *adaptiveLock) TryLock() bool {
+	if l.switched() {
+		return l.wp.TryLock()
+	}
+	if !l.rw.TryLock() {
+		return false
+	}
+	if atomic.LoadInt32(&l.mode) == adaptiveRWMutex {
+		return true
+	}
+	l.rw.Unlock()
+	return l.TryLock()
+}
+
+func (l *adaptiveLock) TryRLock() bool {
+	if l.switched() {
+		return l.wp.TryRLock()
+	}
+	if !l.rw.TryRLock() {
+		return false
+	}
+	if atomic.LoadInt32(&l.mode) == adaptiveRWMutex {
+		return true
+	}
+	l.rw.RUnlock()
+	return l.TryRLock()
+}
@@ -0,0 +1,171 @@
+package util
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Runs concurrent increments, inserts and reads on a map with opts and checks
+// that no update was lost.
+func checkUnderContention(t *testing.T, opts ConcurrentMapStringOpts) *ConcurrentMapString {
+	t.Helper()
+	m := NewConcurrentMapStringWithOpts(opts)
+	const workers, rounds = 16, 500
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				m.Upsert("counter", 1, func(exist bool, old, new interface{}) interface{} {
+					if !exist {
+						return new
+					}
+					return old.(int) + new.(int)
+				})
+				m.Set(strconv.Itoa(w)+"-"+strconv.Itoa(i), i)
+				m.Get("counter")
+				m.Has(strconv.Itoa(i))
+			}
+		}(w)
+	}
+	wg.Wait()
+	if v, _ := m.Get("counter"); v != workers*rounds {
+		t.Fatalf("counter = %v, want %d", v, workers*rounds)
+	}
+	if m.Count() != workers*rounds+1 {
+		t.Fatalf("Count() = %d, want %d", m.Count(), workers*rounds+1)
+	}
+	return m
+}
+
+func TestSpinLock(t *testing.T) {
+	m := checkUnderContention(t, ConcurrentMapStringOpts{ShardCount: 4, SpinLock: true})
+	for _, mode := range m.LockModes() {
+		if mode != "spin" {
+			t.Fatalf("LockModes() = %v", m.LockModes())
+		}
+	}
+}
+
+func TestWriterPreferring(t *testing.T) {
+	m := checkUnderContention(t, ConcurrentMapStringOpts{ShardCount: 4, WriterPreferring: true})
+	for _, mode := range m.LockModes() {
+		if mode != "writer-preferring" {
+			t.Fatalf("LockModes() = %v", m.LockModes())
+		}
+	}
+
+	//readers always holding the read lock of the only shard, overlapping each other
+	m = NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 1, WriterPreferring: true})
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				m.View("k", func(v interface{}, exists bool) {
+					time.Sleep(100 * time.Microsecond)
+				})
+			}
+		}()
+	}
+	withinSecond(t, "writing under sustained reads", func() {
+		for i := 0; i < 50; i++ {
+			m.Set("k", i)
+		}
+	})
+	close(stop)
+	wg.Wait()
+}
+
+func TestAdaptiveLock(t *testing.T) {
+	checkUnderContention(t, ConcurrentMapStringOpts{ShardCount: 4, AdaptiveLock: true})
+
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, AdaptiveLock: true})
+	hot := m.GetShardIndex("hot")
+	var quiet []string
+	for i := 0; len(quiet) < 20; i++ {
+		if key := strconv.Itoa(i); m.GetShardIndex(key) != hot {
+			quiet = append(quiet, key)
+		}
+	}
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if w%2 == 0 {
+					m.View("hot", func(interface{}, bool) {
+						time.Sleep(10 * time.Microsecond)
+					})
+				} else {
+					m.Set("hot", i)
+				}
+			}
+		}(w)
+	}
+	waitFor(t, "the hot shard to switch", func() bool {
+		for _, key := range quiet {
+			m.Set(key, 1) //uncontended
+		}
+		return m.LockModes()[hot] == "adaptive:writer-preferring"
+	})
+	close(stop)
+	wg.Wait()
+	for i, mode := range m.LockModes() {
+		if i != hot && mode != "adaptive:rwmutex" {
+			t.Fatalf("LockModes() = %v, only shard %d was contended", m.LockModes(), hot)
+		}
+	}
+	m.Set("hot", -1)
+	if v, _ := m.Get("hot"); v != -1 {
+		t.Fatalf("Get(hot) = %v after the switch", v)
+	}
+}
+
+// A write-heavy workload of tiny values on few shards.
+func benchmarkTinyWrites(b *testing.B, opts ConcurrentMapStringOpts) {
+	m := NewConcurrentMapStringWithOpts(opts)
+	keys := make([]string, 64)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if i%8 == 0 {
+				m.Get(key)
+			} else {
+				m.Set(key, i)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkTinyWritesRWMutex(b *testing.B) {
+	benchmarkTinyWrites(b, ConcurrentMapStringOpts{ShardCount: 4})
+}
+
+func BenchmarkTinyWritesSpinLock(b *testing.B) {
+	benchmarkTinyWrites(b, ConcurrentMapStringOpts{ShardCount: 4, SpinLock: true})
+}
@@ -0,0 +1,115 @@
+package util
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"time"
+)
+
+const memEvictFraction = 8 //EvictForMemory每次淘汰元素总数的1/8
+
+func heapAlloc() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// If HeapInUse reports more than MemoryLimit, evicts the eighth of the entries
+// which were updated the longest time ago and returns how many were evicted.
+// OnEvict is called for each of them without holding any shard lock. A single
+// pass does not wait for the garbage collector to release the memory, so it
+// is meant to be run periodically, see StartMemoryWatcher.
+func (m *ConcurrentMapString) EvictForMemory() int {
+	m.shards() //initializes the options of a zero value map
+	if m.opts.MemoryLimit == 0 || m.opts.HeapInUse() <= m.opts.MemoryLimit {
+		return 0
+	}
+	type candidate struct {
+		key     string
+		updated time.Time
+	}
+	var candidates []candidate
+	for _, shard := range m.shards() {
+		shard.RLock()
+		for key, meta := range shard.metas {
+			candidates = append(candidates, candidate{key, meta.updated})
+		}
+		shard.RUnlock()
+	}
+	if len(candidates) == 0 {
+		return 0
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].updated.Before(candidates[j].updated)
+	})
+	n := len(candidates) / memEvictFraction
+	if n == 0 {
+		n = 1
+	}
+	victims := make([]string, n)
+	updated := make(map[string]time.Time, n)
+	for i, c := range candidates[:n] {
+		victims[i] = c.key
+		updated[c.key] = c.updated
+	}
+	var evicted []TupleString
+	m.withShardsOf(victims, true, func(shard *concurrentMapSharedString, keys []string) {
+		for _, key := range keys {
+			//spare the entries written since the scan
+			if meta, ok := shard.metas[key]; ok && meta.updated.Equal(updated[key]) {
+				value, _ := shard.remove(key)
+				evicted = append(evicted, TupleString{key, value})
+			}
+		}
+	})
+	for _, t := range evicted {
+		m.evictions.add(t.Key, EvictedMemory, m.now())
+		if m.opts.OnEvict != nil {
+			m.opts.OnEvict(t.Key, m.Uncompress(t.Val))
+		}
+	}
+	return len(evicted)
+}
+
+// Starts a goroutine which calls EvictForMemory every interval. Calling it
+// again restarts the watcher with the new interval. Like the janitor it
+// recovers from panics of OnEvict and hands them to reportPanic.
+func (m *ConcurrentMapString) StartMemoryWatcher(interval time.Duration) {
+	m.StopMemoryWatcher()
+	stop := make(chan struct{})
+	m.hookLock.Lock()
+	m.memoryStop = stop
+	m.hookLock.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.watchMemory()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (m *ConcurrentMapString) watchMemory() {
+	defer func() {
+		if r := recover(); r != nil {
+			m.reportPanic(fmt.Errorf("memory watcher recovered from panic: %v", r))
+		}
+	}()
+	m.EvictForMemory()
+}
+
+// Stops the watcher started by StartMemoryWatcher.
+func (m *ConcurrentMapString) StopMemoryWatcher() {
+	m.hookLock.Lock()
+	if m.memoryStop != nil {
+		close(m.memoryStop)
+		m.memoryStop = nil
+	}
+	m.hookLock.Unlock()
+}
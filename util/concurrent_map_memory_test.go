@@ -0,0 +1,69 @@
+package util
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEvictForMemory(t *testing.T) {
+	clock := newFakeClock()
+	var heap uint64 = 100
+	evicted := make(map[string]interface{})
+	lock := sync.Mutex{}
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{
+		ShardCount:  4,
+		Clock:       clock,
+		MemoryLimit: 1000,
+		HeapInUse: func() uint64 {
+			return atomic.LoadUint64(&heap)
+		},
+		OnEvict: func(key string, value interface{}) {
+			lock.Lock()
+			evicted[key] = value
+			lock.Unlock()
+		},
+	})
+	for i := 0; i < 16; i++ {
+		m.Set(strconv.Itoa(i), i)
+		clock.Advance(time.Second)
+	}
+	m.Set("0", 0) //updated last now
+
+	if n := m.EvictForMemory(); n != 0 || m.Count() != 16 {
+		t.Fatalf("EvictForMemory() = %d below the limit", n)
+	}
+	atomic.StoreUint64(&heap, 2000)
+	if n := m.EvictForMemory(); n != 2 {
+		t.Fatalf("EvictForMemory() = %d above the limit, want an eighth of 16", n)
+	}
+	keys := make([]string, 0, len(evicted))
+	for key := range evicted {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"1", "2"}) || evicted["1"] != 1 {
+		t.Fatalf("OnEvict got %v, want the two oldest entries", evicted)
+	}
+	if m.Has("1") || m.Has("2") || !m.Has("0") {
+		t.Fatal("the wrong entries were evicted")
+	}
+
+	//the watcher keeps evicting while the heap stays above the limit
+	m.StartMemoryWatcher(time.Millisecond)
+	defer m.StopMemoryWatcher()
+	waitFor(t, "the watcher to evict", func() bool {
+		return m.Count() < 8
+	})
+	atomic.StoreUint64(&heap, 100)
+	m.StopMemoryWatcher()
+	count := m.Count()
+	m.Set("new", 1)
+	if m.EvictForMemory() != 0 || m.Count() != count+1 {
+		t.Fatal("entries were evicted below the limit")
+	}
+}
@@ -0,0 +1,43 @@
+package util
+
+import (
+	"time"
+)
+
+// When an entry was created and last updated, tracked in the TrackMeta mode.
+type entryMeta struct {
+	created time.Time
+	updated time.Time
+}
+
+// Retrieves an element together with the time it was created and last updated.
+// The times are zero unless the map was created with TrackMeta.
+func (m *ConcurrentMapString) GetMeta(key string) (value interface{}, created, updated time.Time, ok bool) {
+	key = m.normalize(key)
+	shard := m.rlockShard(key)
+	defer shard.RUnlock()
+	value, ok = shard.lookup(key)
+	if !ok || shard.expired(key, m.now()) {
+		return nil, created, updated, false
+	}
+	meta := shard.metas[key]
+	return m.Uncompress(value), meta.created, meta.updated, true
+}
+
+// Returns the entries last updated after t, for incremental sync. Without
+// TrackMeta there is nothing to compare with, so all the entries are returned:
+// a sync fed by it sends too much rather than missing changes.
+func (m *ConcurrentMapString) ChangedSince(t time.Time) map[string]interface{} {
+	changed := make(map[string]interface{})
+	for _, shard := range m.shards() {
+		shard.RLock()
+		shard.rangeItems(func(key string, val interface{}) bool {
+			if shard.metas == nil || shard.metas[key].updated.After(t) {
+				changed[key] = m.Uncompress(val)
+			}
+			return true
+		})
+		shard.RUnlock()
+	}
+	return changed
+}
@@ -0,0 +1,61 @@
+package util
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGetMeta(t *testing.T) {
+	clock := newFakeClock()
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, TrackMeta: true, Clock: clock})
+	m.Set("a", 1)
+	_, created, updated, ok := m.GetMeta("a")
+	if !ok || !created.Equal(clock.Now()) || !updated.Equal(created) {
+		t.Fatalf("GetMeta(a) = %v, %v, %v after the insert", created, updated, ok)
+	}
+	clock.Advance(time.Minute)
+	m.Set("a", 2)
+	v, created2, updated2, ok := m.GetMeta("a")
+	if !ok || v != 2 || !created2.Equal(created) || !updated2.Equal(clock.Now()) {
+		t.Fatalf("GetMeta(a) = %v, %v, %v, %v after the update", v, created2, updated2, ok)
+	}
+	if _, _, _, ok := m.GetMeta("missing"); ok {
+		t.Fatal("GetMeta found a missing key")
+	}
+
+	plain := NewConcurrentMapString(4)
+	plain.Set("a", 1)
+	if _, created, updated, ok := plain.GetMeta("a"); !ok || !created.IsZero() || !updated.IsZero() {
+		t.Fatal("GetMeta returned times without TrackMeta")
+	}
+}
+
+func TestChangedSince(t *testing.T) {
+	clock := newFakeClock()
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, TrackMeta: true, Clock: clock})
+	for i := 0; i < 20; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	since := clock.Now()
+	clock.Advance(time.Second)
+	want := map[string]interface{}{"3": -3, "11": -11, "new": 0}
+	for key, v := range want {
+		m.Set(key, v)
+	}
+	if got := m.ChangedSince(since); !reflect.DeepEqual(got, want) {
+		t.Fatalf("ChangedSince() = %v, want %v", got, want)
+	}
+	if got := m.ChangedSince(clock.Now()); len(got) != 0 {
+		t.Fatalf("ChangedSince(now) = %v", got)
+	}
+
+	//without TrackMeta everything is reported
+	plain := NewConcurrentMapString(4)
+	plain.Set("a", 1)
+	plain.Set("b", 2)
+	if got := plain.ChangedSince(time.Now()); len(got) != 2 {
+		t.Fatalf("ChangedSince() without TrackMeta = %v, want every entry", got)
+	}
+}
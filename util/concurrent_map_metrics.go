@@ -0,0 +1,54 @@
+package util
+
+import (
+	"sync/atomic"
+)
+
+// Operation counters of the TrackMetrics mode.
+type opCounters struct {
+	gets   int64
+	sets   int64
+	hits   int64
+	misses int64
+}
+
+func (c *opCounters) countGet(hit bool) {
+	atomic.AddInt64(&c.gets, 1)
+	if hit {
+		atomic.AddInt64(&c.hits, 1)
+	} else {
+		atomic.AddInt64(&c.misses, 1)
+	}
+}
+
+// Operation counts since the map was created or ResetMetrics was last called.
+type OpMetrics struct {
+	Gets   int64
+	Sets   int64
+	Hits   int64
+	Misses int64
+}
+
+// Returns the operation counts, all zero unless TrackMetrics is set. Each
+// counter is read atomically, but not all of them at the same instant.
+func (m *ConcurrentMapString) Metrics() OpMetrics {
+	return OpMetrics{
+		Gets:   atomic.LoadInt64(&m.ops.gets),
+		Sets:   atomic.LoadInt64(&m.ops.sets),
+		Hits:   atomic.LoadInt64(&m.ops.hits),
+		Misses: atomic.LoadInt64(&m.ops.misses),
+	}
+}
+
+// Zeroes the operation counts and returns them as they were, e.g. so that each
+// metrics scrape covers its own window. It is safe to call concurrently with the
+// operations; one running at the reset instant may be counted only partly, e.g.
+// as a get but neither a hit nor a miss.
+func (m *ConcurrentMapString) ResetMetrics() OpMetrics {
+	return OpMetrics{
+		Gets:   atomic.SwapInt64(&m.ops.gets, 0),
+		Sets:   atomic.SwapInt64(&m.ops.sets, 0),
+		Hits:   atomic.SwapInt64(&m.ops.hits, 0),
+		Misses: atomic.SwapInt64(&m.ops.misses, 0),
+	}
+}
@@ -0,0 +1,32 @@
+package util
+
+import "testing"
+
+func TestResetMetrics(t *testing.T) {
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, TrackMetrics: true})
+	m.Set("a", 1)
+	m.MSet(map[string]interface{}{"b": 2, "c": 3})
+	m.Get("a")
+	m.Get("missing")
+	if got, want := m.Metrics(), (OpMetrics{Gets: 2, Sets: 3, Hits: 1, Misses: 1}); got != want {
+		t.Fatalf("Metrics() = %+v, want %+v", got, want)
+	}
+	if got, want := m.ResetMetrics(), (OpMetrics{Gets: 2, Sets: 3, Hits: 1, Misses: 1}); got != want {
+		t.Fatalf("ResetMetrics() = %+v, want the counts before the reset %+v", got, want)
+	}
+	if got := m.Metrics(); got != (OpMetrics{}) {
+		t.Fatalf("Metrics() = %+v after ResetMetrics", got)
+	}
+	m.Get("a")
+	m.Get("a")
+	if got, want := m.Metrics(), (OpMetrics{Gets: 2, Hits: 2}); got != want {
+		t.Fatalf("Metrics() = %+v after the reset, want %+v", got, want)
+	}
+
+	plain := NewConcurrentMapString(4)
+	plain.Set("a", 1)
+	plain.Get("a")
+	if got := plain.Metrics(); got != (OpMetrics{}) {
+		t.Fatalf("Metrics() = %+v without TrackMetrics", got)
+	}
+}
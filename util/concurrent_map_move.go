@@ -0,0 +1,81 @@
+package util
+
+import (
+	"sync/atomic"
+)
+
+var mapIDs uint64 //last id handed out by lockOrder
+
+// Returns the position of m in the global lock order of maps, assigned on first use.
+func (m *ConcurrentMapString) lockOrder() uint64 {
+	if id := atomic.LoadUint64(&m.id); id != 0 {
+		return id
+	}
+	atomic.CompareAndSwapUint64(&m.id, 0, atomic.AddUint64(&mapIDs, 1))
+	return atomic.LoadUint64(&m.id)
+}
+
+// Moves the entry under key from src to dst atomically: no reader sees it in
+// both maps or in neither. If dst already holds key, onConflict decides the
+// value stored (a nil onConflict overwrites it). Returns false, changing
+// nothing, if key is not in src or dst rejects the value by TypeGuard or
+// MaxEntries.
+// The shards of different maps are locked in the order of the maps' ids, so
+// concurrent moves in opposite directions cannot deadlock.
+func Move(src, dst *ConcurrentMapString, key string, onConflict UpsertCb) bool {
+	srcKey, dstKey := src.normalize(key), dst.normalize(key)
+	if src == dst && srcKey == dstKey {
+		return src.Has(srcKey)
+	}
+	for {
+		room := -1 //a move within a map does not add an entry
+		if src != dst {
+			room = dst.room()
+		}
+		var from, to *concurrentMapSharedString
+		var locked []*concurrentMapSharedString
+		if src == dst {
+			var owners []*concurrentMapSharedString
+			owners, locked = src.lockShards([]string{srcKey, dstKey})
+			from, to = owners[0], owners[1]
+		} else {
+			from, to = src.shardOf(srcKey), dst.shardOf(dstKey)
+			first, second := from, to
+			if src.lockOrder() > dst.lockOrder() {
+				first, second = to, from
+			}
+			first.Lock()
+			second.Lock()
+			locked = []*concurrentMapSharedString{first, second}
+			if from.retired || to.retired {
+				unlockShards(locked)
+				continue
+			}
+		}
+		v, ok := from.lookup(srcKey)
+		if !ok {
+			unlockShards(locked)
+			return false
+		}
+		old, exists := to.lookup(dstKey)
+		if exists && onConflict != nil {
+			v = onConflict(true, dst.Uncompress(old), src.Uncompress(v))
+		} else if src != dst {
+			//the maps may compress differently
+			v = src.Uncompress(v)
+		}
+		v = dst.compress(v)
+		if !dst.rejectsNil(v) && (dst.checkType(to, dstKey, v) != nil || dst.checkCapacity(to, dstKey, &room) != nil) {
+			unlockShards(locked)
+			return false
+		}
+		from.remove(srcKey)
+		//checked above, a nil removes dstKey in the RejectNil mode
+		inserted, _ := dst.store(to, dstKey, v, nil)
+		unlockShards(locked)
+		if inserted {
+			dst.afterInsert(dstKey)
+		}
+		return true
+	}
+}
@@ -0,0 +1,65 @@
+package util
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestMoveBothWays(t *testing.T) {
+	a, b := NewConcurrentMapString(4), NewConcurrentMapString(4)
+	for i := 0; i < 100; i++ {
+		a.Set("a"+strconv.Itoa(i), i)
+		b.Set("b"+strconv.Itoa(i), i)
+	}
+	wg := sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				Move(a, b, "a"+strconv.Itoa(i%100), nil)
+				Move(a, b, "b"+strconv.Itoa(i%100), nil)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				Move(b, a, "a"+strconv.Itoa(i%100), nil)
+				Move(b, a, "b"+strconv.Itoa(i%100), nil)
+			}
+		}()
+	}
+	withinSecond(t, "moving in both directions", wg.Wait)
+	if a.Count()+b.Count() != 200 {
+		t.Fatalf("%d + %d entries after the moves, want 200", a.Count(), b.Count())
+	}
+	for i := 0; i < 100; i++ {
+		for _, key := range []string{"a" + strconv.Itoa(i), "b" + strconv.Itoa(i)} {
+			if a.Has(key) == b.Has(key) {
+				t.Fatalf("%s is in both maps or in neither", key)
+			}
+		}
+	}
+}
+
+func TestMoveConflict(t *testing.T) {
+	src, dst := NewConcurrentMapString(4), NewConcurrentMapString(4)
+	src.Set("k", 1)
+	dst.Set("k", 2)
+	sum := func(exist bool, old, new interface{}) interface{} {
+		return old.(int) + new.(int)
+	}
+	if !Move(src, dst, "k", sum) {
+		t.Fatal("Move failed")
+	}
+	if src.Has("k") {
+		t.Fatal("Move left the key in src")
+	}
+	if v, _ := dst.Get("k"); v != 3 {
+		t.Fatalf("dst has %v, want onConflict to merge into 3", v)
+	}
+	if Move(src, dst, "k", nil) {
+		t.Fatal("Move of a missing key succeeded")
+	}
+}
@@ -0,0 +1,407 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// A minimal MessagePack codec covering the values JSON can represent plus
+// []byte, so the map needs no third party package for it. Supported values:
+// nil, bool, the int, uint and float types, string, []byte, []interface{} and
+// map[string]interface{}.
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+// Serializes the contents as a MessagePack map, streaming the entries from
+// IterBuffered instead of building a temporary map. Values of other types
+// than the supported ones (see the top of this file) make it fail.
+func (m *ConcurrentMapString) MarshalMsgpack() ([]byte, error) {
+	ch := m.IterBuffered()
+	//IterBuffered buffers the whole snapshot, its capacity is the number of entries
+	var buf bytes.Buffer
+	writeMsgpackMapHeader(&buf, cap(ch))
+	n := 0
+	for item := range ch {
+		writeMsgpackString(&buf, item.Key)
+		if err := writeMsgpack(&buf, item.Val); err != nil {
+			return nil, fmt.Errorf("msgpack: value of %s: %w", item.Key, err)
+		}
+		n++
+	}
+	if n != cap(ch) {
+		return nil, fmt.Errorf("msgpack: %d entries announced, %d written", cap(ch), n)
+	}
+	return buf.Bytes(), nil
+}
+
+// Reverse process of MarshalMsgpack, the decoded entries are added to the map.
+// Integers are decoded as int64 (uint64 if they do not fit), floats as float64
+// or float32, arrays as []interface{} and maps as map[string]interface{}.
+func (m *ConcurrentMapString) UnmarshalMsgpack(b []byte) error {
+	d := msgpackDecoder{b: b}
+	n, err := d.mapHeader()
+	if err != nil {
+		return err
+	}
+	batch := make(map[string]interface{}, jsonDecodeBatch)
+	for i := 0; i < n; i++ {
+		key, err := d.value()
+		if err != nil {
+			return err
+		}
+		k, ok := key.(string)
+		if !ok {
+			return fmt.Errorf("msgpack: map key expected to be a string, got %T", key)
+		}
+		val, err := d.value()
+		if err != nil {
+			return err
+		}
+		batch[k] = val
+		if len(batch) >= jsonDecodeBatch {
+			m.MSet(batch)
+			batch = make(map[string]interface{}, jsonDecodeBatch)
+		}
+	}
+	if len(d.b) > 0 {
+		return fmt.Errorf("msgpack: %d trailing bytes", len(d.b))
+	}
+	m.MSet(batch)
+	return nil
+}
+
+func writeMsgpackMapHeader(buf *bytes.Buffer, n int) {
+	switch {
+	case n < 16:
+		buf.WriteByte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xde)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdf)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func writeMsgpackString(buf *bytes.Buffer, s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xda)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdb)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.WriteString(s)
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, v int64) {
+	switch {
+	case v >= 0 && v < 128, v >= -32 && v < 0:
+		buf.WriteByte(byte(v))
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(v))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(v))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, v)
+	}
+}
+
+func writeMsgpackUint(buf *bytes.Buffer, v uint64) {
+	if v <= math.MaxInt64 {
+		writeMsgpackInt(buf, int64(v))
+		return
+	}
+	buf.WriteByte(0xcf)
+	binary.Write(buf, binary.BigEndian, v)
+}
+
+func writeMsgpack(buf *bytes.Buffer, v interface{}) error {
+	switch value := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if value {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case int:
+		writeMsgpackInt(buf, int64(value))
+	case int8:
+		writeMsgpackInt(buf, int64(value))
+	case int16:
+		writeMsgpackInt(buf, int64(value))
+	case int32:
+		writeMsgpackInt(buf, int64(value))
+	case int64:
+		writeMsgpackInt(buf, value)
+	case uint:
+		writeMsgpackUint(buf, uint64(value))
+	case uint8:
+		writeMsgpackUint(buf, uint64(value))
+	case uint16:
+		writeMsgpackUint(buf, uint64(value))
+	case uint32:
+		writeMsgpackUint(buf, uint64(value))
+	case uint64:
+		writeMsgpackUint(buf, value)
+	case float32:
+		buf.WriteByte(0xca)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(value))
+	case float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(value))
+	case string:
+		writeMsgpackString(buf, value)
+	case []byte:
+		n := len(value)
+		switch {
+		case n <= math.MaxUint8:
+			buf.WriteByte(0xc4)
+			buf.WriteByte(byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xc5)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xc6)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		buf.Write(value)
+	case []interface{}:
+		n := len(value)
+		switch {
+		case n < 16:
+			buf.WriteByte(0x90 | byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xdc)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdd)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		for _, e := range value {
+			if err := writeMsgpack(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		writeMsgpackMapHeader(buf, len(value))
+		for k, e := range value {
+			writeMsgpackString(buf, k)
+			if err := writeMsgpack(buf, e); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported type %T", v)
+	}
+	return nil
+}
+
+type msgpackDecoder struct {
+	b []byte // the data not decoded yet
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if len(d.b) < n {
+		return nil, errMsgpackShort
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b, nil
+}
+
+// Reads a length of size 1, 2 or 4 bytes.
+func (d *msgpackDecoder) length(size int) (int, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	default:
+		return int(binary.BigEndian.Uint32(b)), nil
+	}
+}
+
+func (d *msgpackDecoder) mapHeader() (int, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return d.mapLen(b[0])
+}
+
+// Returns the number of entries of the map starting with the format byte c.
+func (d *msgpackDecoder) mapLen(c byte) (int, error) {
+	switch {
+	case c&0xf0 == 0x80:
+		return int(c & 0x0f), nil
+	case c == 0xde:
+		return d.length(2)
+	case c == 0xdf:
+		return d.length(4)
+	default:
+		return 0, fmt.Errorf("msgpack: map expected, got 0x%02x", c)
+	}
+}
+
+func (d *msgpackDecoder) value() (interface{}, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	case c&0xf0 == 0x90:
+		return d.array(int(c & 0x0f))
+	case c&0xf0 == 0x80:
+		return d.mapValue(c)
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.length(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		raw, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), raw...), nil
+	case 0xca:
+		raw, err := d.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(raw)), nil
+	case 0xcb:
+		raw, err := d.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		raw, err := d.next(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		var v uint64
+		for _, x := range raw {
+			v = v<<8 | uint64(x)
+		}
+		if v > math.MaxInt64 {
+			return v, nil
+		}
+		return int64(v), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		raw, err := d.next(size)
+		if err != nil {
+			return nil, err
+		}
+		var v uint64
+		for _, x := range raw {
+			v = v<<8 | uint64(x)
+		}
+		//sign extend
+		shift := uint(64 - 8*size)
+		return int64(v<<shift) >> shift, nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.length(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(n)
+	case 0xdc, 0xdd:
+		n, err := d.length(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(n)
+	case 0xde, 0xdf:
+		return d.mapValue(c)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported format 0x%02x", c)
+}
+
+func (d *msgpackDecoder) str(n int) (interface{}, error) {
+	raw, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(raw), nil
+}
+
+func (d *msgpackDecoder) array(n int) (interface{}, error) {
+	if n > len(d.b) {
+		//every element takes at least a byte, do not trust a bogus length
+		return nil, errMsgpackShort
+	}
+	arr := make([]interface{}, n)
+	for i := range arr {
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = v
+	}
+	return arr, nil
+}
+
+func (d *msgpackDecoder) mapValue(c byte) (interface{}, error) {
+	n, err := d.mapLen(c)
+	if err != nil {
+		return nil, err
+	}
+	if 2*n > len(d.b) {
+		return nil, errMsgpackShort
+	}
+	obj := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		k, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map key expected to be a string, got %T", key)
+		}
+		if obj[k], err = d.value(); err != nil {
+			return nil, err
+		}
+	}
+	return obj, nil
+}
@@ -0,0 +1,64 @@
+package util
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	want := map[string]interface{}{
+		"nil":    nil,
+		"bool":   true,
+		"small":  int64(5),
+		"neg":    int64(-40000),
+		"big":    int64(math.MaxInt64),
+		"huge":   uint64(math.MaxUint64),
+		"float":  1.5,
+		"string": "héllo",
+		"bytes":  []byte{0, 1, 2},
+		"list":   []interface{}{int64(1), "two", []interface{}{}},
+		"map":    map[string]interface{}{"nested": false},
+	}
+	m.MSet(want)
+	data, err := m.MarshalMsgpack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := NewConcurrentMapString(8)
+	if err := decoded.UnmarshalMsgpack(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.Items(), want) {
+		t.Fatalf("decoded %v, want %v", decoded.Items(), want)
+	}
+
+	if err := decoded.UnmarshalMsgpack(data[:len(data)-1]); err == nil {
+		t.Fatal("UnmarshalMsgpack accepted truncated data")
+	}
+	m.Set("unsupported", struct{}{})
+	if _, err := m.MarshalMsgpack(); err == nil {
+		t.Fatal("MarshalMsgpack accepted an unsupported value")
+	}
+}
+
+func TestMsgpackSmallerThanJSON(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	for i := 0; i < 1000; i++ {
+		m.Set("user:"+strconv.Itoa(i), map[string]interface{}{"id": i, "score": float64(i) / 3, "active": i%2 == 0})
+	}
+	packed, err := m.MarshalMsgpack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packed) >= len(text) {
+		t.Fatalf("MessagePack takes %d bytes, JSON %d", len(packed), len(text))
+	}
+}
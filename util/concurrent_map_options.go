@@ -0,0 +1,127 @@
+package util
+
+import (
+	"time"
+)
+
+const (
+	DEFAULT_SERIAL_ITER_THRESHOLD   = 1024
+	DEFAULT_ADAPTIVE_LOCK_THRESHOLD = 0.25
+)
+
+// Options of ConcurrentMapString, zero values fall back to the defaults.
+type ConcurrentMapStringOpts struct {
+	ShardCount    int
+	KeyNormalizer func(key string) string             //作用于所有传入的key，map里存储的是规范化之后的key。必须是幂等的，比如strings.ToLower
+	LFUCapacity   int                                 //大于0时开启LFU模式，元素总数超过LFUCapacity时淘汰新key所在shard里访问次数最少的元素
+	OnEvict       func(key string, value interface{}) //元素被淘汰后回调，调用时不持有shard锁
+	//大于0时，元素总数超过AutoResizeFactor*ShardCount()会在后台把shard数翻倍。
+	//每次翻倍都要复制全部元素，均摊到每次插入上的代价是O(1)，但翻倍期间所有读写都会被阻塞
+	AutoResizeFactor int
+	MaxValueBytes    int                     //大于0时，Sizer计算出的大小超过MaxValueBytes的value不会被Set写入
+	Sizer            func(v interface{}) int //计算value的字节数，默认只计算string和[]byte的长度
+	ConsistentHash   bool                    //用一致性哈希环代替取模来选择shard，Resize时只有少量key需要换shard，但每次查找要做一次二分
+	//开启后记录每个key第一次写入的value类型，之后写入其他类型会被拒绝：SetChecked返回error，Set、MSet、Upsert不做修改。
+	//TypeGuardPanic为true时改为直接panic
+	TypeGuard      bool
+	TypeGuardPanic bool
+	SpinLock       bool //每个shard用自旋锁代替sync.RWMutex，适合临界区极短、写多的场景
+	//每个shard用写优先的读写锁代替sync.RWMutex：有写者等待时新的读者都会阻塞，持续不断的读不会让写饿死，代价是读多时读的吞吐变低。
+	//sync.RWMutex在写者等待时也会阻塞新读者，但写者之间会和刚被唤醒的读者交替获得锁。SpinLock为true时忽略
+	WriterPreferring bool
+	//每个shard先用sync.RWMutex，统计每1024次加锁中需要等待的比例，达到AdaptiveLockThreshold(默认0.25)后这个shard永久切换为写优先的读写锁，见LockModes。
+	//统计本身有少量开销。SpinLock或WriterPreferring为true时忽略
+	AdaptiveLock          bool
+	AdaptiveLockThreshold float64
+	TrackMeta             bool //记录每个元素的创建时间和最后更新时间，见GetMeta
+	//记录每个shard内key的插入顺序，IterBuffered、IterCb、Range和Keys按shard下标顺序、shard内按插入顺序输出。Resize后顺序按旧shard依次合并
+	Ordered bool
+	Hasher  func(key string) uint32 //key的哈希函数，决定key落在哪个shard。默认算法以后可能会变，需要跨版本稳定时用DeterministicHasher
+	//不为0且没有设置Hasher时，key的哈希值混入Seed，每个部署用不同的随机Seed可以防止攻击者构造落在同一个shard的key(hash flooding)
+	Seed                 uint32
+	CountRefreshInterval time.Duration //EstimateCount缓存的元素总数的刷新间隔，不大于0时EstimateCount等同于Count
+	//Get未命中时调用Loader加载value，found为true时用SetIfAbsent存入map。同一个key的并发未命中只调用一次Loader
+	Loader func(key string) (value interface{}, found bool, err error)
+	//Loader加载的元素HardTTL后过期，之后的Get会阻塞等待重新加载。SoftTTL(小于HardTTL)后Get仍然立即返回旧值，同时在后台调用一次Loader刷新。
+	//HardTTL为0时加载的元素不过期，SoftTTL不起作用
+	SoftTTL             time.Duration
+	HardTTL             time.Duration
+	JanitorErrorHandler func(err error) //RegisterOnExpire注册的回调panic或StartJanitor启动的清理协程panic，恢复后调用，其余回调照常执行。为nil时写入Log（未调用InitLogger时写入标准库log）
+	//大于0时，插入新key后如果它所在shard的元素数超过平均值的HotShardFactor倍，只把这个shard拆分成几个子shard，比Resize代价小。
+	//每个shard最多拆分一次，Resize和ReplaceAll会取消拆分
+	HotShardFactor int
+	//大于0时，每个shard的元素数不超过SmallShardSize时按key排序存放在切片里，超过时才转为map，删除到SmallShardSize/2以下时再转回切片。
+	//元素很少的shard分配更少、局部性更好，元素多时没有好处。行为和公开接口不变，WithShard的回调期间shard临时转为map
+	SmallShardSize int
+	//元素数少于SerialIterThreshold时，IterBuffered、Items和Keys在调用者的协程里逐个shard遍历，不再为每个shard启动协程。
+	//默认1024，小于0时总是并发遍历
+	SerialIterThreshold int
+	//大于0时，IterBuffered、Iter、Items和Keys等为每个shard启动的协程在整个map上同时最多MaxIterGoroutines个，
+	//超出时迭代的调用者阻塞等待空位，避免大量并发迭代一个shard很多的map时创建过多协程
+	MaxIterGoroutines int
+	//大于0时，所有写入方法把长度超过CompressThreshold的string和[]byte用ValueCodec压缩后存储，读取、遍历、回调和序列化看到的都是原值，
+	//只有WithShard、ShardHandle和AddIndex的keyFunc直接看到存储的*CompressedValue。ValueCodec默认GzipCodec
+	CompressThreshold int
+	ValueCodec        ValueCodec
+	//大于0时，元素总数达到MaxEntries后所有会创建新key的方法都拒绝写入新key(SetChecked、SetCtx、Append返回ErrMapFull，SetIfAbsent等报告失败，其余不做修改)，
+	//已有key仍可更新，不淘汰任何元素。整体替换内容的ReplaceAll、ReplaceShard、WithShard不受限制。
+	//元素数在加shard锁之前检查，并发插入时可能略微超过MaxEntries
+	MaxEntries   int
+	RejectNil    bool //为true时所有写入方法写入nil都等同于删除这个key(SetIfAbsent等不插入，Upsert回调返回nil时删除)，Loader返回nil视为未找到，Get不会返回(nil, true)。只判断无类型的nil
+	TrackMetrics bool //统计Get的调用、命中、未命中次数和Set、SetChecked、SetWithTTL、SetCtx、MSet写入的元素数，见Metrics
+	//调试用：WithShard、WithShardResult的回调拿到的是items的副本，回调返回后副本被清空并放入一个哨兵key。
+	//回调把副本泄露出去并在锁外写入时，之后对同一个shard调用WithShard或IterCb会panic。每次调用都要复制整个shard，不要在生产环境开启
+	DebugLeaks bool
+	//大于0时，StartMemoryWatcher启动的协程和EvictForMemory在HeapInUse返回的堆内存字节数超过MemoryLimit时，每次淘汰最久没有更新的1/8元素，并调用OnEvict。
+	//会自动开启TrackMeta。HeapInUse默认读取runtime.MemStats.HeapAlloc，测试时可以注入
+	MemoryLimit uint64
+	HeapInUse   func() uint64
+	Clock       Clock //判断元素是否过期、janitor清理、TrackMeta的时间戳、IncrementWindowed和RecentEvictions使用的时钟，默认系统时钟。测试时可以注入假时钟，不用真的sleep
+}
+
+func (options *ConcurrentMapStringOpts) Init() {
+	if options.ShardCount <= 0 {
+		options.ShardCount = DEFAULT_SHARD_COUNT
+	}
+	if options.Sizer == nil {
+		options.Sizer = defaultSizer
+	}
+	if options.Hasher == nil && options.Seed != 0 {
+		seed := options.Seed
+		options.Hasher = func(key string) uint32 {
+			return fnv32Seed(seed, key)
+		}
+	}
+	if options.Hasher == nil {
+		options.Hasher = fnv32
+	}
+	if options.CompressThreshold > 0 && options.ValueCodec == nil {
+		options.ValueCodec = GzipCodec{}
+	}
+	if options.AdaptiveLockThreshold <= 0 {
+		options.AdaptiveLockThreshold = DEFAULT_ADAPTIVE_LOCK_THRESHOLD
+	}
+	if options.MemoryLimit > 0 {
+		options.TrackMeta = true
+	}
+	if options.HeapInUse == nil {
+		options.HeapInUse = heapAlloc
+	}
+	if options.Clock == nil {
+		options.Clock = realClock{}
+	}
+	if options.SerialIterThreshold == 0 {
+		options.SerialIterThreshold = DEFAULT_SERIAL_ITER_THRESHOLD
+	}
+}
+
+func defaultSizer(v interface{}) int {
+	switch value := v.(type) {
+	case string:
+		return len(value)
+	case []byte:
+		return len(value)
+	default:
+		return 0
+	}
+}
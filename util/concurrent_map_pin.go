@@ -0,0 +1,51 @@
+package util
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Places key in the shard at shardIndex instead of where its hash puts it, e.g.
+// to give a hot key a shard of its own or to reproduce a layout in tests. A
+// stored key is moved there. Once any key is pinned, every lookup checks the
+// pins first, which costs a sync.Map read. Operations on key racing with
+// PinKey may miss it. Pins whose index is beyond the shard count, e.g. after
+// shrinking with Resize, are ignored.
+func (m *ConcurrentMapString) PinKey(key string, shardIndex int) error {
+	key = m.normalize(key)
+	tables, base := m.layout()
+	if shardIndex < 0 || shardIndex >= len(tables) {
+		return fmt.Errorf("shard index %d out of range [0, %d)", shardIndex, len(tables))
+	}
+	for {
+		from := m.locate(key, tables, base)
+		first, second := tables[from], tables[shardIndex]
+		if from > shardIndex {
+			first, second = second, first
+		}
+		first.Lock()
+		if second != first {
+			second.Lock()
+		}
+		retired := first.retired || second.retired
+		if !retired {
+			if _, ok := m.pins.LoadOrStore(key, shardIndex); ok {
+				m.pins.Store(key, shardIndex)
+			} else {
+				atomic.AddInt32(&m.pinCount, 1)
+			}
+			if _, ok := tables[from].lookup(key); ok && from != shardIndex {
+				tables[from].copyEntry(key, tables[shardIndex])
+				tables[from].remove(key)
+			}
+		}
+		if second != first {
+			second.Unlock()
+		}
+		first.Unlock()
+		if !retired {
+			return nil
+		}
+		tables, base = m.layout()
+	}
+}
@@ -0,0 +1,31 @@
+package util
+
+import "testing"
+
+func TestPinKey(t *testing.T) {
+	m := NewConcurrentMapString(8)
+	m.Set("hot", 1)
+	target := (m.GetShardIndex("hot") + 1) % 8
+	if err := m.PinKey("hot", target); err != nil {
+		t.Fatal(err)
+	}
+	if idx := m.GetShardIndex("hot"); idx != target {
+		t.Fatalf("GetShardIndex(hot) = %d, pinned to %d", idx, target)
+	}
+	if v, ok := m.Get("hot"); !ok || v != 1 {
+		t.Fatalf("Get(hot) = %v, %v after pinning", v, ok)
+	}
+	items, _ := m.ShardItems(target)
+	if items["hot"] != 1 {
+		t.Fatalf("the shard pinned to holds %v", items)
+	}
+	m.Set("hot", 2)
+	m.Set("pinned later", 3)
+	m.PinKey("pinned later", target)
+	if items, _ := m.ShardItems(target); items["hot"] != 2 || items["pinned later"] != 3 || m.Count() != 2 {
+		t.Fatalf("the shard pinned to holds %v, Count() = %d", items, m.Count())
+	}
+	if err := m.PinKey("hot", 8); err == nil {
+		t.Fatal("PinKey accepted an index out of range")
+	}
+}
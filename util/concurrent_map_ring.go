@@ -0,0 +1,71 @@
+package util
+
+import (
+	"sort"
+	"strconv"
+)
+
+const ringReplicas = 64 //每个shard在哈希环上的虚拟节点数
+
+// A consistent-hash ring over shard indexes. Growing the number of shards only
+// remaps about 1/shardCount of the keys, whereas modulo remaps almost all of them.
+// The price is a binary search per lookup instead of a single modulo.
+type hashRing struct {
+	shardCount int
+	points     []uint32 //sorted
+	shards     []int    //shards[i] owns points[i]
+}
+
+func newHashRing(shardCount int) *hashRing {
+	ring := &hashRing{
+		shardCount: shardCount,
+		points:     make([]uint32, 0, shardCount*ringReplicas),
+	}
+	owner := make(map[uint32]int, shardCount*ringReplicas)
+	for shard := 0; shard < shardCount; shard++ {
+		for i := 0; i < ringReplicas; i++ {
+			point := mix32(fnv32(strconv.Itoa(shard) + "#" + strconv.Itoa(i)))
+			if _, ok := owner[point]; ok {
+				continue
+			}
+			owner[point] = shard
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	ring.shards = make([]int, len(ring.points))
+	for i, point := range ring.points {
+		ring.shards[i] = owner[point]
+	}
+	return ring
+}
+
+// Returns the shard owning the first point clockwise from hash.
+func (ring *hashRing) get(hash uint32) int {
+	hash = mix32(hash)
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= hash })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.shards[i]
+}
+
+// Returns the ring for shardCount shards, the last one built is cached.
+func (m *ConcurrentMapString) ringOf(shardCount int) *hashRing {
+	if ring, ok := m.ring.Load().(*hashRing); ok && ring.shardCount == shardCount {
+		return ring
+	}
+	ring := newHashRing(shardCount)
+	m.ring.Store(ring)
+	return ring
+}
+
+// Finalizer of murmur3, spreads the similar fnv32 hashes of similar keys over the ring.
+func mix32(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
@@ -0,0 +1,59 @@
+package util
+
+// Exported handle of a single shard for custom low level operations, see
+// ShardByIndex. Sharp edges:
+//   - Get, Set, Remove, Len and Each MUST be called with the lock held, the
+//     write lock for Set and Remove.
+//   - keys are used as is: they MUST already be normalized and belong to this
+//     shard (GetShardIndex), otherwise Get on the map will not find them.
+//     So are values: in the CompressThreshold mode Get and Each return the
+//     stored *CompressedValue (see Uncompress) and Set stores values as given.
+//   - Set and Remove bypass the LFU capacity, the automatic resize, TypeGuard,
+//     MaxValueBytes and the hooks. TTLs are honored only by the map methods.
+//   - ReplaceAll, Resize and hot shard splits retire the shard, writes to a
+//     retired shard are lost. Check Retired after locking.
+//   - never lock two handles in descending index order, or lock a handle while
+//     calling methods of the map.
+type ShardHandle struct {
+	shard *concurrentMapSharedString
+}
+
+// Returns the handle of the i-th shard, i MUST be in [0, ShardCount()).
+func (m *ConcurrentMapString) ShardByIndex(i int) ShardHandle {
+	return ShardHandle{shard: m.shards()[i]}
+}
+
+func (h ShardHandle) Lock()    { h.shard.Lock() }
+func (h ShardHandle) Unlock()  { h.shard.Unlock() }
+func (h ShardHandle) RLock()   { h.shard.RLock() }
+func (h ShardHandle) RUnlock() { h.shard.RUnlock() }
+
+// Reports whether the shard has been swapped out of the map.
+func (h ShardHandle) Retired() bool {
+	return h.shard.retired
+}
+
+// Returns the value under key.
+func (h ShardHandle) Get(key string) (interface{}, bool) {
+	return h.shard.lookup(key)
+}
+
+// Stores value under key and reports whether key is new.
+func (h ShardHandle) Set(key string, value interface{}) bool {
+	return h.shard.set(key, value)
+}
+
+// Deletes key and returns its old value.
+func (h ShardHandle) Remove(key string) (interface{}, bool) {
+	return h.shard.remove(key)
+}
+
+// Returns the number of entries.
+func (h ShardHandle) Len() int {
+	return h.shard.size()
+}
+
+// Calls fn for every entry until it returns false. fn MUST NOT add or remove entries.
+func (h ShardHandle) Each(fn func(key string, value interface{}) bool) {
+	h.shard.each(fn)
+}
@@ -0,0 +1,85 @@
+package util
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// A custom operation: zeroes the counters of every shard, each shard atomically,
+// and returns their total.
+func drainCounters(m *ConcurrentMapString) int {
+	total := 0
+	for i := 0; i < m.ShardCount(); i++ {
+		h := m.ShardByIndex(i)
+		h.Lock()
+		if h.Retired() {
+			h.Unlock()
+			continue
+		}
+		var keys []string
+		h.Each(func(key string, value interface{}) bool {
+			keys = append(keys, key)
+			total += value.(int)
+			return true
+		})
+		for _, key := range keys {
+			h.Set(key, 0)
+		}
+		h.Unlock()
+	}
+	return total
+}
+
+func TestShardHandle(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	want := make(map[string]interface{})
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+		want[strconv.Itoa(i)] = 0
+	}
+	if total := drainCounters(m); total != 4950 {
+		t.Fatalf("drained %d, want 4950", total)
+	}
+	checkContents(t, m, want)
+
+	h := m.ShardByIndex(m.GetShardIndex("new"))
+	h.Lock()
+	if !h.Set("new", 1) || h.Len() == 0 {
+		t.Fatal("ShardHandle.Set did not insert")
+	}
+	h.Unlock()
+	if v, _ := m.Get("new"); v != 1 {
+		t.Fatalf("Get(new) = %v after ShardHandle.Set", v)
+	}
+	h.Lock()
+	if v, ok := h.Remove("new"); !ok || v != 1 {
+		t.Fatalf("ShardHandle.Remove(new) = %v, %v", v, ok)
+	}
+	h.Unlock()
+	if m.Has("new") || m.Count() != 100 {
+		t.Fatal("ShardHandle.Remove left the key")
+	}
+}
+
+func TestIterShardCb(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	for idx := 0; idx < 4; idx++ {
+		want, _ := m.ShardItems(idx)
+		got := make(map[string]interface{})
+		if err := m.IterShardCb(idx, func(key string, v interface{}) {
+			got[key] = v
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("IterShardCb(%d) visited %v, want %v", idx, got, want)
+		}
+	}
+	if err := m.IterShardCb(4, func(string, interface{}) {}); err == nil {
+		t.Fatal("IterShardCb accepted an index out of range")
+	}
+}
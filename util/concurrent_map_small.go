@@ -0,0 +1,195 @@
+package util
+
+import "sort"
+
+// An entry of a shard in the small representation, see SmallShardSize.
+type smallEntry struct {
+	key string
+	val interface{}
+}
+
+// The accessors below are the only code reading or writing items and small
+// directly. A shard holds its entries in small, sorted by key, while items is
+// nil, and in items otherwise. Without SmallShardSize small stays empty, so
+// the accessors add one nil check to the plain map access. The lock MUST be
+// held by all of them, the write lock by those modifying the shard.
+
+// Returns the position of key in small, or where it would be inserted.
+func (shard *concurrentMapSharedString) smallIndex(key string) (int, bool) {
+	lo, hi := 0, len(shard.small)
+	for lo < hi {
+		h := int(uint(lo+hi) >> 1)
+		if shard.small[h].key < key {
+			lo = h + 1
+		} else {
+			hi = h
+		}
+	}
+	return lo, lo < len(shard.small) && shard.small[lo].key == key
+}
+
+// Returns the value stored under key.
+func (shard *concurrentMapSharedString) lookup(key string) (interface{}, bool) {
+	if shard.items != nil {
+		v, ok := shard.items[key]
+		return v, ok
+	}
+	if i, ok := shard.smallIndex(key); ok {
+		return shard.small[i].val, true
+	}
+	return nil, false
+}
+
+// Like lookup, for the key given as bytes. Both string(key) conversions are
+// done by the compiler without allocating, the one in the map index expression
+// and the one in the comparison.
+func (shard *concurrentMapSharedString) lookupBytes(key []byte) (interface{}, bool) {
+	if shard.items != nil {
+		v, ok := shard.items[string(key)]
+		return v, ok
+	}
+	lo, hi := 0, len(shard.small)
+	for lo < hi {
+		h := int(uint(lo+hi) >> 1)
+		if shard.small[h].key < string(key) {
+			lo = h + 1
+		} else {
+			hi = h
+		}
+	}
+	if lo < len(shard.small) && shard.small[lo].key == string(key) {
+		return shard.small[lo].val, true
+	}
+	return nil, false
+}
+
+// Returns the number of entries.
+func (shard *concurrentMapSharedString) size() int {
+	if shard.items != nil {
+		return len(shard.items)
+	}
+	return len(shard.small)
+}
+
+// Stores value under key without any bookkeeping, promoting the shard to items
+// once small would grow past smallMax, i.e. on the first write without
+// SmallShardSize.
+func (shard *concurrentMapSharedString) put(key string, value interface{}) {
+	if shard.items == nil {
+		i, ok := shard.smallIndex(key)
+		if ok {
+			shard.small[i].val = value
+			return
+		}
+		if len(shard.small) < shard.smallMax {
+			if shard.small == nil {
+				shard.small = make([]smallEntry, 0, shard.smallMax)
+			}
+			shard.small = append(shard.small, smallEntry{})
+			copy(shard.small[i+1:], shard.small[i:])
+			shard.small[i] = smallEntry{key: key, val: value}
+			return
+		}
+		shard.promote(0)
+	}
+	shard.items[key] = value
+}
+
+// Deletes key without any bookkeeping. A promoted shard goes back to small
+// once it shrank to half of smallMax, so that keys coming and going around the
+// threshold do not convert it back and forth on every write.
+func (shard *concurrentMapSharedString) del(key string) {
+	if shard.items != nil {
+		delete(shard.items, key)
+		if len(shard.items) <= shard.smallMax/2 && shard.smallMax > 0 {
+			shard.demote()
+		}
+		return
+	}
+	if i, ok := shard.smallIndex(key); ok {
+		last := len(shard.small) - 1
+		copy(shard.small[i:], shard.small[i+1:])
+		shard.small[last] = smallEntry{}
+		shard.small = shard.small[:last]
+	}
+}
+
+// Calls fn for every entry until it returns false, in random order. fn MAY
+// update or remove the key it is called with, but no other one.
+func (shard *concurrentMapSharedString) rangeItems(fn func(key string, value interface{}) bool) {
+	if items := shard.items; items != nil {
+		//a demotion by fn leaves items as it was, it still yields each remaining key once
+		for key, value := range items {
+			if !fn(key, value) {
+				return
+			}
+		}
+		return
+	}
+	//backwards, removing the current entry only moves the ones already visited
+	small := shard.small
+	for i := len(small) - 1; i >= 0; i-- {
+		if !fn(small[i].key, small[i].val) {
+			return
+		}
+	}
+}
+
+// Returns the entries as a map, promoting the shard if needed, for the code
+// handing it out (WithShard, ReplaceShard). Call fit once done with it.
+func (shard *concurrentMapSharedString) itemsMap() map[string]interface{} {
+	if shard.items == nil {
+		shard.promote(0)
+	}
+	return shard.items
+}
+
+// Makes the shard hold items, which it takes ownership of.
+func (shard *concurrentMapSharedString) setItems(items map[string]interface{}) {
+	if items == nil {
+		items = make(map[string]interface{})
+	}
+	shard.items = items
+	shard.small = nil
+	shard.fit()
+}
+
+// Moves the entries into a map of the given capacity, at least their number.
+func (shard *concurrentMapSharedString) promote(capacity int) {
+	if capacity < len(shard.small) {
+		capacity = len(shard.small)
+	}
+	items := make(map[string]interface{}, capacity)
+	if shard.items != nil {
+		for key, value := range shard.items {
+			items[key] = value
+		}
+	}
+	for _, e := range shard.small {
+		items[e.key] = e.val
+	}
+	shard.items = items
+	shard.small = nil
+}
+
+// Moves the entries of items into small.
+func (shard *concurrentMapSharedString) demote() {
+	small := make([]smallEntry, 0, shard.smallMax)
+	for key, value := range shard.items {
+		small = append(small, smallEntry{key: key, val: value})
+	}
+	sort.Slice(small, func(i, j int) bool {
+		return small[i].key < small[j].key
+	})
+	shard.small = small
+	shard.items = nil
+	shard.reserved = 0
+}
+
+// Demotes the shard if its entries fit into small, after items was handed out
+// or replaced as a whole.
+func (shard *concurrentMapSharedString) fit() {
+	if shard.smallMax > 0 && shard.items != nil && len(shard.items) <= shard.smallMax {
+		shard.demote()
+	}
+}
@@ -0,0 +1,187 @@
+package util
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Fails unless m holds exactly the entries of want, through every read path.
+func checkContents(t *testing.T, m *ConcurrentMapString, want map[string]interface{}) {
+	t.Helper()
+	if m.Count() != len(want) {
+		t.Fatalf("Count() = %d, want %d", m.Count(), len(want))
+	}
+	for key, val := range want {
+		if got, ok := m.Get(key); !ok || got != val {
+			t.Fatalf("Get(%q) = %v, %v, want %v", key, got, ok, val)
+		}
+	}
+	if items := m.Items(); len(items) != len(want) {
+		t.Fatalf("Items() has %d entries, want %d", len(items), len(want))
+	}
+	if keys := m.Keys(); len(keys) != len(want) {
+		t.Fatalf("Keys() has %d entries, want %d", len(keys), len(want))
+	}
+	n := 0
+	m.IterCb(func(key string, val interface{}) {
+		if want[key] != val {
+			t.Fatalf("IterCb got %q = %v, want %v", key, val, want[key])
+		}
+		n++
+	})
+	if n != len(want) {
+		t.Fatalf("IterCb visited %d entries, want %d", n, len(want))
+	}
+}
+
+func TestSmallShardsMatchMap(t *testing.T) {
+	for _, opts := range []ConcurrentMapStringOpts{
+		{ShardCount: 2, SmallShardSize: 4},
+		{ShardCount: 2, SmallShardSize: 4, Ordered: true, TrackMeta: true, TypeGuard: true, LFUCapacity: 1000},
+		{ShardCount: 1, SmallShardSize: 1},
+		{ShardCount: 2},
+	} {
+		m := NewConcurrentMapStringWithOpts(opts)
+		want := make(map[string]interface{})
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 20000; i++ {
+			key := "k" + strconv.Itoa(r.Intn(30))
+			switch r.Intn(10) {
+			case 0, 1, 2, 3:
+				m.Set(key, i)
+				want[key] = i
+			case 4, 5, 6:
+				m.Remove(key)
+				delete(want, key)
+			case 7:
+				m.WithShard(key, func(items map[string]interface{}) {
+					items[key] = -i
+				})
+				want[key] = -i
+			case 8:
+				if r.Intn(50) == 0 {
+					m.RemovePrefix("k1")
+					for k := range want {
+						if strings.HasPrefix(k, "k1") {
+							delete(want, k)
+						}
+					}
+				}
+			case 9:
+				if r.Intn(100) == 0 {
+					m.Resize(1 + r.Intn(4))
+				}
+			}
+			if i%97 == 0 {
+				checkContents(t, m, want)
+			}
+		}
+		checkContents(t, m, want)
+	}
+}
+
+func TestSmallShardPromotionAndDemotion(t *testing.T) {
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 1, SmallShardSize: 8})
+	shard := m.shards()[0]
+	want := make(map[string]interface{})
+	for i := 0; i < 8; i++ {
+		m.Set(strconv.Itoa(i), i)
+		want[strconv.Itoa(i)] = i
+	}
+	if shard.items != nil || len(shard.small) != 8 {
+		t.Fatalf("8 entries: items %v, small %d entries, want the small representation", shard.items, len(shard.small))
+	}
+	checkContents(t, m, want)
+
+	m.Set("x", 1)
+	want["x"] = 1
+	if shard.items == nil || shard.small != nil {
+		t.Fatal("9 entries: the shard was not promoted")
+	}
+	checkContents(t, m, want)
+
+	//hysteresis: demoted at SmallShardSize/2 entries only
+	for i := 0; i < 5; i++ {
+		m.Remove(strconv.Itoa(i))
+		delete(want, strconv.Itoa(i))
+		if i < 4 && shard.items == nil {
+			t.Fatalf("%d entries: demoted too early", m.Count())
+		}
+	}
+	if shard.items != nil || len(shard.small) != 4 {
+		t.Fatalf("4 entries: items %v, small %d entries, want the small representation", shard.items, len(shard.small))
+	}
+	checkContents(t, m, want)
+	for i := 1; i < len(shard.small); i++ {
+		if shard.small[i-1].key >= shard.small[i].key {
+			t.Fatalf("small not sorted: %q before %q", shard.small[i-1].key, shard.small[i].key)
+		}
+	}
+
+	m.MapValues(func(key string, v interface{}) interface{} {
+		return v.(int) * 2
+	})
+	for key, v := range want {
+		want[key] = v.(int) * 2
+	}
+	checkContents(t, m, want)
+	m.TransformOrDelete(func(key string, v interface{}) (interface{}, bool) {
+		return v, key != "x"
+	})
+	delete(want, "x")
+	checkContents(t, m, want)
+
+	//WithShard hands out a map and demotes the shard again afterwards
+	m.WithShard("5", func(items map[string]interface{}) {
+		if len(items) != len(want) {
+			t.Errorf("WithShard got %d entries, want %d", len(items), len(want))
+		}
+		items["y"] = 3
+	})
+	want["y"] = 3
+	if shard.items != nil {
+		t.Fatal("not demoted after WithShard")
+	}
+	checkContents(t, m, want)
+}
+
+// A sparse map: many shards holding a handful of keys each.
+func benchmarkSparse(b *testing.B, smallShardSize int) {
+	keys := make([]string, 64)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 32, SmallShardSize: smallShardSize})
+		for _, key := range keys {
+			m.Set(key, i)
+		}
+		for _, key := range keys {
+			m.Get(key)
+		}
+	}
+}
+
+func BenchmarkSparseMap(b *testing.B)         { benchmarkSparse(b, 0) }
+func BenchmarkSparseSmallShards(b *testing.B) { benchmarkSparse(b, 8) }
+
+func BenchmarkSparseGet(b *testing.B) {
+	for _, size := range []int{0, 8} {
+		b.Run("SmallShardSize="+strconv.Itoa(size), func(b *testing.B) {
+			m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 32, SmallShardSize: size})
+			keys := make([]string, 64)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("key-%d", i)
+				m.Set(keys[i], i)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m.Get(keys[i%len(keys)])
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package util
+
+import (
+	"sync/atomic"
+)
+
+const (
+	hotShardSplit    = 4  //热点shard拆分成的子shard数，包括它自己
+	hotShardMinCount = 64 //元素少于这个数的shard不拆分，避免刚开始写入时误判
+)
+
+// Splits the shard owning key into hotShardSplit sub-shards if it holds more
+// than HotShardFactor times the average number of elements per shard. Shards
+// are split only once, sub-shards are never split further.
+func (m *ConcurrentMapString) splitIfHot(key string) {
+	tables, base := m.layout()
+	idx := m.locate(key, tables, base)
+	shard := tables[idx]
+	if idx >= base || shard.subs != nil {
+		return
+	}
+	count := int(atomic.LoadInt64(&shard.count))
+	if count < hotShardMinCount || count <= m.opts.HotShardFactor*m.Count()/len(tables) {
+		return
+	}
+	m.splitShard(idx, shard)
+}
+
+// Moves the entries of the hot shard at idx into a fresh shard taking its place
+// and hotShardSplit-1 sub-shards appended to tables. Like Resize the old shard
+// is retired, so operations blocked on it retry on the new shards.
+func (m *ConcurrentMapString) splitShard(idx int, shard *concurrentMapSharedString) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if idx >= len(m.tables) || m.tables[idx] != shard {
+		//split, resized or replaced meanwhile
+		return
+	}
+	fresh := m.newShards(hotShardSplit)
+	tables := make([]*concurrentMapSharedString, len(m.tables), len(m.tables)+hotShardSplit-1)
+	copy(tables, m.tables)
+	tables[idx] = fresh[0]
+	fresh[0].subs = make([]int, hotShardSplit-1)
+	for i, sub := range fresh[1:] {
+		fresh[0].subs[i] = len(tables)
+		tables = append(tables, sub)
+	}
+	shard.Lock()
+	shard.each(func(key string, value interface{}) bool {
+		shard.copyEntry(key, tables[m.locate(key, tables, m.base)])
+		return true
+	})
+	shard.retire()
+	shard.Unlock()
+	m.tables = tables
+}
@@ -0,0 +1,41 @@
+package util
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHotShardSplit(t *testing.T) {
+	//all the hot keys land in shard 0, the others spread over shards 1 to 7
+	hasher := func(key string) uint32 {
+		if strings.HasPrefix(key, "hot") {
+			return fnv32(key) * 8
+		}
+		return fnv32(key)*8 + 1 + fnv32(key)%7
+	}
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 8, Hasher: hasher, HotShardFactor: 2})
+	want := make(map[string]interface{})
+	for i := 0; i < 70; i++ {
+		m.Set("cold"+strconv.Itoa(i), i)
+		want["cold"+strconv.Itoa(i)] = i
+	}
+	for i := 0; i < 200; i++ {
+		m.Set("hot"+strconv.Itoa(i), i)
+		want["hot"+strconv.Itoa(i)] = i
+	}
+	if m.ShardCount() != 8+hotShardSplit-1 {
+		t.Fatalf("ShardCount() = %d, want the hot shard split into %d", m.ShardCount(), hotShardSplit)
+	}
+	for i, shard := range m.shards() {
+		if (shard.subs != nil) != (i == 0) {
+			t.Fatalf("shard %d split: %v", i, shard.subs)
+		}
+	}
+	checkContents(t, m, want)
+	m.Resize(8)
+	if m.ShardCount() != 8 {
+		t.Fatal("Resize did not undo the split")
+	}
+	checkContents(t, m, want)
+}
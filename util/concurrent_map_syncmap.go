@@ -0,0 +1,28 @@
+package util
+
+import (
+	"sync"
+)
+
+// Creates a map with shardCount shards holding a copy of the entries of m, to
+// ease migrating code from sync.Map. Entries whose key is not a string are
+// skipped.
+func FromSyncMap(m *sync.Map, shardCount int) *ConcurrentMapString {
+	rect := NewConcurrentMapString(shardCount)
+	m.Range(func(key, value interface{}) bool {
+		if k, ok := key.(string); ok {
+			rect.Set(k, value)
+		}
+		return true
+	})
+	return rect
+}
+
+// Returns a sync.Map holding a copy of the entries of m.
+func (m *ConcurrentMapString) ToSyncMap() *sync.Map {
+	rect := new(sync.Map)
+	m.IterCb(func(key string, v interface{}) {
+		rect.Store(key, v)
+	})
+	return rect
+}
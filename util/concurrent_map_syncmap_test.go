@@ -0,0 +1,28 @@
+package util
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestSyncMapRoundTrip(t *testing.T) {
+	in := new(sync.Map)
+	want := map[string]interface{}{"a": 1, "b": "two", "c": []int{3}}
+	for key, v := range want {
+		in.Store(key, v)
+	}
+	in.Store(42, "not a string key")
+	m := FromSyncMap(in, 4)
+	if !reflect.DeepEqual(m.Items(), want) {
+		t.Fatalf("FromSyncMap() holds %v, want %v", m.Items(), want)
+	}
+	got := make(map[string]interface{})
+	m.ToSyncMap().Range(func(key, value interface{}) bool {
+		got[key.(string)] = value
+		return true
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ToSyncMap() holds %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,223 @@
+package util
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// The source of the current time for the TTLs, see ConcurrentMapStringOpts.Clock.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// Returns the current time of the clock of m.
+func (m *ConcurrentMapString) now() time.Time {
+	if m.opts.Clock == nil {
+		//not initialized yet
+		return time.Now()
+	}
+	return m.opts.Clock.Now()
+}
+
+// Sets the given value under the specified key, it expires after ttl.
+// Expired entries are treated as absent and removed lazily by Get.
+func (m *ConcurrentMapString) SetWithTTL(key string, value interface{}, ttl time.Duration) {
+	m.checkNil()
+	if m.opts.TrackMetrics {
+		atomic.AddInt64(&m.ops.sets, 1)
+	}
+	if m.rejectsNil(value) {
+		//store would remove it as well, but without setting a deadline
+		m.Remove(key)
+		return
+	}
+	value = m.compress(value)
+	key = m.normalize(key)
+	room := m.room()
+	shard := m.lockShard(key)
+	inserted, err := m.store(shard, key, value, &room)
+	if err != nil {
+		shard.Unlock()
+		return
+	}
+	if shard.expires == nil {
+		shard.expires = make(map[string]time.Time)
+	}
+	shard.expires[key] = m.now().Add(ttl)
+	shard.Unlock()
+	if inserted {
+		m.afterInsert(key)
+	}
+}
+
+// Resets the TTL of key to newTTL if it expires within window, returns whether
+// the deadline was refreshed. Missing, already expired entries and entries
+// without a TTL are left untouched.
+func (m *ConcurrentMapString) RefreshIfExpiringWithin(key string, window, newTTL time.Duration) bool {
+	key = m.normalize(key)
+	shard := m.lockShard(key)
+	defer shard.Unlock()
+	deadline, ok := shard.expires[key]
+	if !ok {
+		return false
+	}
+	now := m.now()
+	if !now.Before(deadline) || deadline.Sub(now) >= window {
+		return false
+	}
+	shard.expires[key] = now.Add(newTTL)
+	return true
+}
+
+// Returns the number of elements which have not expired yet.
+// Unlike Count() it has to read lock and scan every shard.
+func (m *ConcurrentMapString) CountLive() int {
+	now := m.now()
+	count := 0
+	for _, shard := range m.shards() {
+		shard.RLock()
+		if len(shard.expires) == 0 {
+			count += shard.size()
+		} else {
+			shard.rangeItems(func(key string, _ interface{}) bool {
+				if !shard.expired(key, now) {
+					count++
+				}
+				return true
+			})
+		}
+		shard.RUnlock()
+	}
+	return count
+}
+
+// Checks whether key has a deadline before now, the read lock MUST be held.
+func (shard *concurrentMapSharedString) expired(key string, now time.Time) bool {
+	if len(shard.expires) == 0 {
+		return false
+	}
+	deadline, ok := shard.expires[key]
+	return ok && !now.Before(deadline)
+}
+
+// Registers fn to be called with every entry removed because it expired, either
+// by the janitor or lazily by Get. fn is called without holding any shard lock.
+// Explicit removals do not trigger it. A panic of fn is recovered and handed to
+// JanitorErrorHandler, or logged without one.
+func (m *ConcurrentMapString) RegisterOnExpire(fn func(key string, value interface{})) {
+	m.hookLock.Lock()
+	m.onExpire = append(m.onExpire, fn)
+	m.hookLock.Unlock()
+}
+
+func (m *ConcurrentMapString) fireExpire(key string, value interface{}) {
+	m.evictions.add(key, EvictedExpired, m.now())
+	m.hookLock.RLock()
+	hooks := m.onExpire
+	m.hookLock.RUnlock()
+	if len(hooks) > 0 {
+		value = m.Uncompress(value)
+	}
+	for _, fn := range hooks {
+		m.callExpireHook(fn, key, value)
+	}
+}
+
+// Hands a recovered panic to JanitorErrorHandler, or logs it to Log without
+// one (the standard logger if InitLogger was not called).
+func (m *ConcurrentMapString) reportPanic(err error) {
+	if m.opts.JanitorErrorHandler != nil {
+		m.opts.JanitorErrorHandler(err)
+	} else if Log != nil {
+		Log.Print(err)
+	} else {
+		log.Print(err)
+	}
+}
+
+// Calls an OnExpire hook, its panic is recovered and handed to reportPanic so
+// that the other hooks still run.
+func (m *ConcurrentMapString) callExpireHook(fn func(key string, value interface{}), key string, value interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			m.reportPanic(fmt.Errorf("OnExpire hook recovered from panic on %s: %v", key, r))
+		}
+	}()
+	fn(key, value)
+}
+
+// Starts a goroutine which removes the expired entries every interval.
+// Calling it again restarts the janitor with the new interval.
+func (m *ConcurrentMapString) StartJanitor(interval time.Duration) {
+	m.StopJanitor()
+	stop := make(chan struct{})
+	m.hookLock.Lock()
+	m.janitorStop = stop
+	m.hookLock.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.sweep()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Runs DeleteExpired for the janitor. The OnExpire hooks recover their own
+// panics (see callExpireHook), any other panic must not kill the janitor
+// either, so it is recovered and handed to reportPanic; the rest of the expired
+// entries are removed on the next tick.
+func (m *ConcurrentMapString) sweep() {
+	defer func() {
+		if r := recover(); r != nil {
+			m.reportPanic(fmt.Errorf("janitor recovered from panic: %v", r))
+		}
+	}()
+	m.DeleteExpired()
+}
+
+// Stops the janitor started by StartJanitor.
+func (m *ConcurrentMapString) StopJanitor() {
+	m.hookLock.Lock()
+	if m.janitorStop != nil {
+		close(m.janitorStop)
+		m.janitorStop = nil
+	}
+	m.hookLock.Unlock()
+}
+
+// Removes all the expired entries, shard by shard. The OnExpire hooks are
+// called after the lock of each shard is released.
+func (m *ConcurrentMapString) DeleteExpired() {
+	for _, shard := range m.shards() {
+		now := m.now()
+		var expired []TupleString
+		shard.Lock()
+		if shard.retired {
+			//swapped out by ReplaceAll or Resize meanwhile, its entries live on in the new shards
+			shard.Unlock()
+			continue
+		}
+		for key := range shard.expires {
+			if shard.expired(key, now) {
+				value, _ := shard.remove(key)
+				expired = append(expired, TupleString{key, value})
+			}
+		}
+		shard.Unlock()
+		for _, t := range expired {
+			m.fireExpire(t.Key, t.Val)
+		}
+	}
+}
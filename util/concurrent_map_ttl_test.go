@@ -0,0 +1,147 @@
+package util
+
+import (
+	"bytes"
+	"log"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHookPanicsAreLoggedWithoutHandler(t *testing.T) {
+	var buf bytes.Buffer
+	saved := Log
+	Log = log.New(&buf, "", 0)
+	defer func() { Log = saved }()
+
+	clock := newFakeClock()
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, Clock: clock})
+	called := false
+	m.RegisterOnExpire(func(key string, value interface{}) {
+		panic("boom")
+	})
+	m.RegisterOnExpire(func(key string, value interface{}) {
+		called = true
+	})
+	m.SetWithTTL("a", 1, time.Second)
+	clock.Advance(2 * time.Second)
+	if _, ok := m.Get("a"); ok {
+		t.Fatal("expired entry returned")
+	}
+	if !called {
+		t.Fatal("the hook after the panicking one was not called")
+	}
+	if !strings.Contains(buf.String(), "OnExpire hook recovered from panic on a: boom") {
+		t.Fatalf("panic not logged, log: %q", buf.String())
+	}
+}
+
+func TestLazyExpiration(t *testing.T) {
+	clock := newFakeClock()
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, Clock: clock})
+	for i := 0; i < 10; i++ {
+		m.SetWithTTL(strconv.Itoa(i), i, time.Second)
+	}
+	m.Set("forever", 1)
+	if n := m.CountLive(); n != 11 {
+		t.Fatalf("CountLive() = %d, want 11", n)
+	}
+	clock.Advance(2 * time.Second)
+	if n := m.CountLive(); n != 1 {
+		t.Fatalf("CountLive() = %d after the TTL, want 1", n)
+	}
+	if n := m.Count(); n != 11 {
+		t.Fatalf("Count() = %d before the reads, want 11", n)
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok := m.Get(strconv.Itoa(i)); ok {
+			t.Fatalf("Get(%d) returned an expired entry", i)
+		}
+	}
+	if n := m.Count(); n != 1 {
+		t.Fatalf("Count() = %d after the reads, want 1", n)
+	}
+}
+
+func TestJanitorFiresOnExpire(t *testing.T) {
+	clock := newFakeClock()
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, Clock: clock})
+	expired := make(chan TupleString, 10)
+	m.RegisterOnExpire(func(key string, value interface{}) {
+		expired <- TupleString{key, value}
+	})
+	m.SetWithTTL("a", 1, time.Second)
+	m.SetWithTTL("b", 2, time.Hour)
+	m.Set("c", 3)
+	m.Remove("c")
+	clock.Advance(time.Minute)
+	m.StartJanitor(time.Millisecond)
+	defer m.StopJanitor()
+	select {
+	case tuple := <-expired:
+		if tuple.Key != "a" || tuple.Val != 1 {
+			t.Fatalf("OnExpire got %v", tuple)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnExpire was not called")
+	}
+	m.StopJanitor()
+	if len(expired) != 0 {
+		t.Fatalf("OnExpire also got %v", <-expired)
+	}
+	if m.Has("a") || !m.Has("b") {
+		t.Fatal("the janitor removed the wrong entries")
+	}
+}
+
+func TestRefreshIfExpiringWithin(t *testing.T) {
+	clock := newFakeClock()
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, Clock: clock})
+	m.SetWithTTL("soon", 1, 10*time.Second)
+	m.SetWithTTL("later", 2, time.Hour)
+	if !m.RefreshIfExpiringWithin("soon", time.Minute, time.Hour) {
+		t.Fatal("an entry within the window was not refreshed")
+	}
+	if m.RefreshIfExpiringWithin("later", time.Minute, 2*time.Hour) {
+		t.Fatal("an entry outside the window was refreshed")
+	}
+	if m.RefreshIfExpiringWithin("missing", time.Minute, time.Hour) {
+		t.Fatal("a missing entry was refreshed")
+	}
+	//soon got the new TTL, later kept its deadline
+	clock.Advance(time.Hour - time.Second)
+	if !m.Has("soon") || !m.Has("later") {
+		t.Fatal("entries expired too early")
+	}
+	clock.Advance(2 * time.Second)
+	if m.Has("later") {
+		t.Fatal("the entry outside the window got a new TTL")
+	}
+}
+
+func TestClockDrivesExpiry(t *testing.T) {
+	clock := newFakeClock()
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, Clock: clock})
+	start := time.Now()
+	m.SetWithTTL("a", 1, time.Hour)
+	clock.Advance(time.Hour - time.Nanosecond)
+	if !m.Has("a") {
+		t.Fatal("expired before its deadline on the injected clock")
+	}
+	clock.Advance(time.Nanosecond)
+	if m.Has("a") {
+		t.Fatal("still present at its deadline on the injected clock")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("an hour of TTL took %v of real time", elapsed)
+	}
+
+	//the default clock is the real one
+	real := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4})
+	real.SetWithTTL("a", 1, time.Hour)
+	real.SetWithTTL("b", 1, -time.Second)
+	if !real.Has("a") || real.Has("b") {
+		t.Fatal("the default clock is not the real time")
+	}
+}
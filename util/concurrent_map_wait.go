@@ -0,0 +1,54 @@
+package util
+
+import (
+	"context"
+)
+
+// Returns the value under key, blocking until it is set by another goroutine if
+// it is absent. Gives up with ctx.Err() if ctx is done first.
+func (m *ConcurrentMapString) WaitForKey(ctx context.Context, key string) (interface{}, error) {
+	key = m.normalize(key)
+	for {
+		if val, ok := m.Get(key); ok {
+			return val, nil
+		}
+		shard := m.lockShard(key)
+		if _, ok := shard.lookup(key); ok && !shard.expired(key, m.now()) {
+			//set between Get and lockShard
+			shard.Unlock()
+			continue
+		}
+		ch := make(chan struct{})
+		if shard.waiters == nil {
+			shard.waiters = make(map[string][]chan struct{})
+		}
+		shard.waiters[key] = append(shard.waiters[key], ch)
+		shard.Unlock()
+		select {
+		case <-ch:
+			//set or the shard was retired, check again
+		case <-ctx.Done():
+			shard.Lock()
+			shard.dropWaiter(key, ch)
+			shard.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Removes ch from the waiters of key, if set has not closed it yet.
+// The write lock MUST be held.
+func (shard *concurrentMapSharedString) dropWaiter(key string, ch chan struct{}) {
+	chs := shard.waiters[key]
+	for i, c := range chs {
+		if c == ch {
+			chs = append(chs[:i], chs[i+1:]...)
+			break
+		}
+	}
+	if len(chs) == 0 {
+		delete(shard.waiters, key)
+	} else {
+		shard.waiters[key] = chs
+	}
+}
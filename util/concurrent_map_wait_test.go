@@ -0,0 +1,45 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWaitForKey(t *testing.T) {
+	m := NewConcurrentMapString(4)
+	m.Set("present", 1)
+	if v, err := m.WaitForKey(context.Background(), "present"); err != nil || v != 1 {
+		t.Fatalf("WaitForKey(present) = %v, %v", v, err)
+	}
+
+	got := make(chan interface{})
+	go func() {
+		v, err := m.WaitForKey(context.Background(), "later")
+		if err != nil {
+			t.Error(err)
+		}
+		got <- v
+	}()
+	select {
+	case v := <-got:
+		t.Fatalf("WaitForKey returned %v before the key was set", v)
+	case <-time.After(10 * time.Millisecond):
+	}
+	m.Set("later", 2)
+	select {
+	case v := <-got:
+		if v != 2 {
+			t.Fatalf("WaitForKey returned %v, want 2", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForKey did not unblock")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := m.WaitForKey(ctx, "never"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("WaitForKey(never) = %v, want the ctx error", err)
+	}
+}
@@ -0,0 +1,43 @@
+package util
+
+import (
+	"time"
+)
+
+// Hits of a key counted by IncrementWindowed, oldest first.
+type slidingWindow struct {
+	hits []time.Time
+}
+
+// Records a hit of key and returns the number of its hits within the last
+// window, e.g. to rate limit clients by ID. Older hits are discarded under the
+// shard lock. A value under key not set by IncrementWindowed is overwritten. A
+// missing key is not created while the map holds MaxEntries entries, 0 is
+// returned then.
+func (m *ConcurrentMapString) IncrementWindowed(key string, window time.Duration) int {
+	key = m.normalize(key)
+	room := m.room()
+	shard := m.lockShard(key)
+	now := m.now()
+	v, _ := shard.lookup(key)
+	w, ok := v.(*slidingWindow)
+	if !ok {
+		w = &slidingWindow{}
+		if m.checkType(shard, key, w) != nil || m.checkCapacity(shard, key, &room) != nil {
+			shard.Unlock()
+			return 0
+		}
+	}
+	start := now.Add(-window)
+	expired := 0
+	for expired < len(w.hits) && !w.hits[expired].After(start) {
+		expired++
+	}
+	w.hits = append(w.hits[expired:], now)
+	inserted := shard.set(key, w)
+	shard.Unlock()
+	if inserted {
+		m.afterInsert(key)
+	}
+	return len(w.hits)
+}
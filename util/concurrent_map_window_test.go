@@ -0,0 +1,29 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIncrementWindowed(t *testing.T) {
+	clock := newFakeClock()
+	m := NewConcurrentMapStringWithOpts(ConcurrentMapStringOpts{ShardCount: 4, Clock: clock})
+	for i := 1; i <= 5; i++ {
+		if n := m.IncrementWindowed("client", time.Second); n != i {
+			t.Fatalf("hit %d counted as %d", i, n)
+		}
+		clock.Advance(100 * time.Millisecond)
+	}
+	//the first hits slide out of the window one by one
+	clock.Advance(550 * time.Millisecond)
+	if n := m.IncrementWindowed("client", time.Second); n != 5 {
+		t.Fatalf("%d hits in the window, want 5", n)
+	}
+	clock.Advance(2 * time.Second)
+	if n := m.IncrementWindowed("client", time.Second); n != 1 {
+		t.Fatalf("%d hits after waiting past the window, want 1", n)
+	}
+	if n := m.IncrementWindowed("other", time.Second); n != 1 {
+		t.Fatalf("another key starts at %d", n)
+	}
+}
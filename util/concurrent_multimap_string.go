@@ -0,0 +1,62 @@
+package util
+
+// A "thread" safe multimap of type string:[]Anything, built on the shards of
+// ConcurrentMapString. Every key holds the list of values added under it.
+type ConcurrentMultiMapString struct {
+	m *ConcurrentMapString
+}
+
+// Creates a new concurrent multimap.
+func NewConcurrentMultiMapString(shardCount int) *ConcurrentMultiMapString {
+	return &ConcurrentMultiMapString{m: NewConcurrentMapString(shardCount)}
+}
+
+// Appends value to the values of key.
+func (mm *ConcurrentMultiMapString) Add(key string, value interface{}) {
+	mm.m.Append(key, value)
+}
+
+// Returns a copy of the values of key, in the order they were added.
+func (mm *ConcurrentMultiMapString) Get(key string) []interface{} {
+	key = mm.m.normalize(key)
+	shard := mm.m.rlockShard(key)
+	defer shard.RUnlock()
+	stored, _ := shard.lookup(key)
+	list, _ := stored.([]interface{})
+	if len(list) == 0 {
+		return nil
+	}
+	return append([]interface{}{}, list...)
+}
+
+// Removes the first value of key which eq reports equal to value, the key
+// itself is removed with its last value. Returns whether a value was removed.
+func (mm *ConcurrentMultiMapString) RemoveValue(key string, value interface{}, eq func(a, b interface{}) bool) bool {
+	key = mm.m.normalize(key)
+	shard := mm.m.lockShard(key)
+	defer shard.Unlock()
+	stored, _ := shard.lookup(key)
+	list, _ := stored.([]interface{})
+	for i, v := range list {
+		if !eq(v, value) {
+			continue
+		}
+		if len(list) == 1 {
+			shard.remove(key)
+			return true
+		}
+		shard.set(key, append(list[:i], list[i+1:]...))
+		return true
+	}
+	return false
+}
+
+// Removes key with all its values.
+func (mm *ConcurrentMultiMapString) Remove(key string) {
+	mm.m.Remove(key)
+}
+
+// Returns the number of keys.
+func (mm *ConcurrentMultiMapString) Count() int {
+	return mm.m.Count()
+}
@@ -0,0 +1,31 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMultiMap(t *testing.T) {
+	mm := NewConcurrentMultiMapString(4)
+	mm.Add("k", 1)
+	mm.Add("k", 2)
+	mm.Add("k", 3)
+	mm.Add("other", "x")
+	if values := mm.Get("k"); !reflect.DeepEqual(values, []interface{}{1, 2, 3}) {
+		t.Fatalf("Get(k) = %v", values)
+	}
+	eq := func(a, b interface{}) bool { return a == b }
+	if !mm.RemoveValue("k", 2, eq) {
+		t.Fatal("RemoveValue(k, 2) failed")
+	}
+	if mm.RemoveValue("k", 4, eq) {
+		t.Fatal("RemoveValue removed a value never added")
+	}
+	if values := mm.Get("k"); !reflect.DeepEqual(values, []interface{}{1, 3}) {
+		t.Fatalf("Get(k) = %v after removing 2", values)
+	}
+	mm.RemoveValue("other", "x", eq)
+	if mm.Get("other") != nil || mm.Count() != 1 {
+		t.Fatal("removing the last value left the key")
+	}
+}
@@ -0,0 +1,85 @@
+package util
+
+// A "thread" safe set of strings, sharded like ConcurrentMapString on which it
+// is built with empty values.
+type ConcurrentSetString struct {
+	m *ConcurrentMapString
+}
+
+// Creates a new concurrent set.
+func NewConcurrentSetString(shardCount int) *ConcurrentSetString {
+	return &ConcurrentSetString{m: NewConcurrentMapString(shardCount)}
+}
+
+// Adds key to the set, reports whether it was not a member yet.
+func (s *ConcurrentSetString) Add(key string) bool {
+	return s.m.SetIfAbsent(key, struct{}{})
+}
+
+// Removes key from the set.
+func (s *ConcurrentSetString) Remove(key string) {
+	s.m.Remove(key)
+}
+
+// Reports whether key is a member of the set.
+func (s *ConcurrentSetString) Contains(key string) bool {
+	return s.m.Has(key)
+}
+
+// Returns the number of members.
+func (s *ConcurrentSetString) Len() int {
+	return s.m.Count()
+}
+
+// Returns all the members.
+func (s *ConcurrentSetString) Members() []string {
+	return s.m.Keys()
+}
+
+// Returns a buffered iterator over a snapshot of the members, which could be
+// used in a for range loop.
+func (s *ConcurrentSetString) Iter() <-chan string {
+	keys := s.m.Keys()
+	ch := make(chan string, len(keys))
+	for _, key := range keys {
+		ch <- key
+	}
+	close(ch)
+	return ch
+}
+
+// Returns a new set with the members of s or other.
+func (s *ConcurrentSetString) Union(other *ConcurrentSetString) *ConcurrentSetString {
+	res := NewConcurrentSetString(s.m.ShardCount())
+	s.m.KeysCb(func(key string) bool {
+		res.Add(key)
+		return true
+	})
+	other.m.KeysCb(func(key string) bool {
+		res.Add(key)
+		return true
+	})
+	return res
+}
+
+// Returns a new set with the members of s which are members of other too.
+func (s *ConcurrentSetString) Intersect(other *ConcurrentSetString) *ConcurrentSetString {
+	res := NewConcurrentSetString(s.m.ShardCount())
+	for _, key := range s.m.Keys() {
+		if other.Contains(key) {
+			res.Add(key)
+		}
+	}
+	return res
+}
+
+// Returns a new set with the members of s which are not members of other.
+func (s *ConcurrentSetString) Difference(other *ConcurrentSetString) *ConcurrentSetString {
+	res := NewConcurrentSetString(s.m.ShardCount())
+	for _, key := range s.m.Keys() {
+		if !other.Contains(key) {
+			res.Add(key)
+		}
+	}
+	return res
+}
@@ -0,0 +1,65 @@
+package util
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func newSet(members ...string) *ConcurrentSetString {
+	s := NewConcurrentSetString(4)
+	for _, key := range members {
+		s.Add(key)
+	}
+	return s
+}
+
+func sortedMembers(s *ConcurrentSetString) []string {
+	members := s.Members()
+	sort.Strings(members)
+	return members
+}
+
+func TestSetMembership(t *testing.T) {
+	s := NewConcurrentSetString(4)
+	if !s.Add("a") || s.Add("a") {
+		t.Fatal("Add did not report a new member exactly once")
+	}
+	s.Add("b")
+	if !s.Contains("a") || s.Contains("c") || s.Len() != 2 {
+		t.Fatalf("Contains(a) = %v, Contains(c) = %v, Len() = %d", s.Contains("a"), s.Contains("c"), s.Len())
+	}
+	s.Remove("a")
+	if s.Contains("a") || s.Len() != 1 {
+		t.Fatal("Remove left the member")
+	}
+	var iterated []string
+	for key := range s.Iter() {
+		iterated = append(iterated, key)
+	}
+	if !reflect.DeepEqual(iterated, []string{"b"}) {
+		t.Fatalf("Iter() yielded %v", iterated)
+	}
+}
+
+func TestSetAlgebra(t *testing.T) {
+	a, b := newSet("1", "2", "3"), newSet("2", "3", "4")
+	for _, c := range []struct {
+		name string
+		got  *ConcurrentSetString
+		want []string
+	}{
+		{"Union", a.Union(b), []string{"1", "2", "3", "4"}},
+		{"Intersect", a.Intersect(b), []string{"2", "3"}},
+		{"Difference", a.Difference(b), []string{"1"}},
+		{"Difference reversed", b.Difference(a), []string{"4"}},
+		{"Intersect empty", a.Intersect(newSet()), []string{}},
+	} {
+		if got := sortedMembers(c.got); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s = %v, want %v", c.name, got, c.want)
+		}
+	}
+	if !reflect.DeepEqual(sortedMembers(a), []string{"1", "2", "3"}) {
+		t.Fatalf("the operations changed their receiver to %v", sortedMembers(a))
+	}
+}
@@ -0,0 +1,235 @@
+// Command typedmap generates a sharded "thread" safe map with string keys and
+// values of a single type, so that no type assertions are needed, e.g.
+//
+//	//go:generate go run ./gen/typedmap -name ConcurrentMapInt -type int -tuple TupleInt -out concurrent_map_int.go
+//
+// The generated map lives in the package of the go:generate directive and
+// reuses its fnv32 and DEFAULT_SHARD_COUNT, so it is meant for package util.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"os"
+	"text/template"
+)
+
+var tmpl = template.Must(template.New("typedmap").Parse(`// Code generated by typedmap -name {{.Name}} -type {{.Type}} -tuple {{.Tuple}}; DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"sync"
+)
+
+// A "thread" safe map of type string:{{.Type}}.
+// To avoid lock bottlenecks this map is dived to several (DEFAULT_SHARD_COUNT) map shards.
+type {{.Name}} struct {
+	tables []*{{.Shard}}
+}
+
+// A key/value pair of {{.Name}}, used by IterBuffered.
+type {{.Tuple}} struct {
+	Key string
+	Val {{.Type}}
+}
+
+// A "thread" safe string to {{.Type}} map.
+type {{.Shard}} struct {
+	items map[string]{{.Type}}
+	sync.RWMutex // Read Write mutex, guards access to internal map.
+}
+
+// Creates a new concurrent map.
+func New{{.Name}}(shardCount int) *{{.Name}} {
+	if shardCount <= 0 {
+		shardCount = DEFAULT_SHARD_COUNT
+	}
+	m := &{{.Name}}{tables: make([]*{{.Shard}}, shardCount)}
+	for i := range m.tables {
+		m.tables[i] = &{{.Shard}}{items: make(map[string]{{.Type}})}
+	}
+	return m
+}
+
+func (m *{{.Name}}) shardOf(key string) *{{.Shard}} {
+	return m.tables[uint(fnv32(key))%uint(len(m.tables))]
+}
+
+// Sets the given value under the specified key.
+func (m *{{.Name}}) Set(key string, value {{.Type}}) {
+	shard := m.shardOf(key)
+	shard.Lock()
+	shard.items[key] = value
+	shard.Unlock()
+}
+
+// Sets the given value under the specified key if no value was associated with it.
+func (m *{{.Name}}) SetIfAbsent(key string, value {{.Type}}) bool {
+	shard := m.shardOf(key)
+	shard.Lock()
+	_, ok := shard.items[key]
+	if !ok {
+		shard.items[key] = value
+	}
+	shard.Unlock()
+	return !ok
+}
+
+// Inserts or updates the value under key with the result of cb, called under the shard lock.
+func (m *{{.Name}}) Upsert(key string, value {{.Type}}, cb func(exist bool, valueInMap, newValue {{.Type}}) {{.Type}}) {{.Type}} {
+	shard := m.shardOf(key)
+	shard.Lock()
+	v, ok := shard.items[key]
+	res := cb(ok, v, value)
+	shard.items[key] = res
+	shard.Unlock()
+	return res
+}
+
+// Retrieves an element from map under given key.
+func (m *{{.Name}}) Get(key string) ({{.Type}}, bool) {
+	shard := m.shardOf(key)
+	shard.RLock()
+	val, ok := shard.items[key]
+	shard.RUnlock()
+	return val, ok
+}
+
+// Looks up an item under specified key.
+func (m *{{.Name}}) Has(key string) bool {
+	_, ok := m.Get(key)
+	return ok
+}
+
+// Removes an element from the map.
+func (m *{{.Name}}) Remove(key string) {
+	shard := m.shardOf(key)
+	shard.Lock()
+	delete(shard.items, key)
+	shard.Unlock()
+}
+
+// Returns the number of elements within the map.
+func (m *{{.Name}}) Count() int {
+	count := 0
+	for _, shard := range m.tables {
+		shard.RLock()
+		count += len(shard.items)
+		shard.RUnlock()
+	}
+	return count
+}
+
+// Returns all keys as []string.
+func (m *{{.Name}}) Keys() []string {
+	keys := make([]string, 0, m.Count())
+	for _, shard := range m.tables {
+		shard.RLock()
+		for key := range shard.items {
+			keys = append(keys, key)
+		}
+		shard.RUnlock()
+	}
+	return keys
+}
+
+// Callback based iterator, fn is called under the read lock of each shard.
+func (m *{{.Name}}) IterCb(fn func(key string, v {{.Type}})) {
+	for _, shard := range m.tables {
+		shard.RLock()
+		for key, value := range shard.items {
+			fn(key, value)
+		}
+		shard.RUnlock()
+	}
+}
+
+// Returns a buffered iterator which could be used in a for range loop. The
+// values come through as {{.Type}}, no interface boxing or type assertion.
+func (m *{{.Name}}) IterBuffered() <-chan {{.Tuple}} {
+	chans := snapshot{{.Name}}(m)
+	total := 0
+	for _, c := range chans {
+		total += cap(c)
+	}
+	ch := make(chan {{.Tuple}}, total)
+	go fanIn{{.Name}}(chans, ch)
+	return ch
+}
+
+// Copies each shard into its own buffered channel.
+func snapshot{{.Name}}(m *{{.Name}}) []chan {{.Tuple}} {
+	chans := make([]chan {{.Tuple}}, len(m.tables))
+	wg := sync.WaitGroup{}
+	wg.Add(len(m.tables))
+	for index, shard := range m.tables {
+		go func(index int, shard *{{.Shard}}) {
+			shard.RLock()
+			chans[index] = make(chan {{.Tuple}}, len(shard.items))
+			wg.Done()
+			for key, val := range shard.items {
+				chans[index] <- {{.Tuple}}{key, val}
+			}
+			shard.RUnlock()
+			close(chans[index])
+		}(index, shard)
+	}
+	wg.Wait()
+	return chans
+}
+
+// Reads from each of chans and writes to out, which is closed at the end.
+func fanIn{{.Name}}(chans []chan {{.Tuple}}, out chan {{.Tuple}}) {
+	wg := sync.WaitGroup{}
+	wg.Add(len(chans))
+	for _, ch := range chans {
+		go func(ch chan {{.Tuple}}) {
+			for t := range ch {
+				out <- t
+			}
+			wg.Done()
+		}(ch)
+	}
+	wg.Wait()
+	close(out)
+}
+`))
+
+func main() {
+	name := flag.String("name", "", "name of the generated map type, e.g. ConcurrentMapInt")
+	typ := flag.String("type", "", "value type, e.g. int")
+	tuple := flag.String("tuple", "", "name of the key/value pair type of IterBuffered, e.g. TupleInt")
+	out := flag.String("out", "", "output file, stdout if empty")
+	pkg := flag.String("package", os.Getenv("GOPACKAGE"), "package of the generated file")
+	flag.Parse()
+	if *name == "" || *typ == "" || *tuple == "" || *pkg == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, map[string]string{
+		"Package": *pkg,
+		"Name":    *name,
+		"Type":    *typ,
+		"Shard":   "shard" + *name,
+		"Tuple":   *tuple,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *out == "" {
+		os.Stdout.Write(src)
+		return
+	}
+	if err := ioutil.WriteFile(*out, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,4 @@
+package util
+
+//go:generate go run ./gen/typedmap -name ConcurrentMapInt -type int -tuple TupleInt -out concurrent_map_int.go
+//go:generate go run ./gen/typedmap -name ConcurrentStrStrMap -type string -tuple TupleStrStr -out concurrent_map_strstr.go